@@ -0,0 +1,164 @@
+package teapot_hacker_isolation
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminAccess guards adminPath (or metricsPath) with a bearer token and/or a list of client networks, at least one is required.
+type AdminAccess struct {
+	token    [32]byte // sha256, so the comparison doesn't leak the length either
+	hasToken bool
+	networks []*net.IPNet
+}
+
+// NewAdminAccess returns nil if adminPath isn't set
+func NewAdminAccess(config *Config) (*AdminAccess, error) {
+	if config.AdminPath == "" {
+		return nil, nil
+	}
+	return newEndpointAccess("admin", config.AdminToken, config.AdminAllowedNetworks)
+}
+
+// NewMetricsAccess returns nil if metricsPath isn't set
+func NewMetricsAccess(config *Config) (*AdminAccess, error) {
+	if config.MetricsPath == "" {
+		return nil, nil
+	}
+	return newEndpointAccess("metrics", config.MetricsToken, config.MetricsAllowedNetworks)
+}
+
+// newEndpointAccess takes the <endpoint>Token and <endpoint>AllowedNetworks options
+func newEndpointAccess(endpoint string, token string, allowedNetworks []string) (*AdminAccess, error) {
+	if token == "" && len(allowedNetworks) == 0 {
+		return nil, fmt.Errorf("%sPath requires %sToken and/or %sAllowedNetworks", endpoint, endpoint, endpoint)
+	}
+	a := &AdminAccess{}
+	if token != "" {
+		a.token, a.hasToken = sha256.Sum256([]byte(token)), true
+	}
+	for _, n := range allowedNetworks {
+		if !strings.Contains(n, "/") {
+			if ip := net.ParseIP(n); ip != nil && ip.To4() != nil {
+				n += "/32"
+			} else {
+				n += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("%sAllowedNetworks: %w", endpoint, err)
+		}
+		a.networks = append(a.networks, network)
+	}
+	return a, nil
+}
+
+// Allow returns the status to refuse req with, or 0 if it may use the admin endpoint
+func (a *AdminAccess) Allow(req *http.Request) int {
+	if len(a.networks) > 0 {
+		ip := net.ParseIP(clientIP(req))
+		allowed := false
+		for _, network := range a.networks {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return http.StatusForbidden
+		}
+	}
+	if a.hasToken {
+		auth := req.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			return http.StatusUnauthorized
+		}
+		sum := sha256.Sum256([]byte(strings.TrimSpace(auth[7:])))
+		if subtle.ConstantTimeCompare(sum[:], a.token[:]) != 1 {
+			return http.StatusUnauthorized
+		}
+	}
+	return 0
+}
+
+// refuse answers a request Allow turned down, realm is for the bearer challenge
+func refuse(rw http.ResponseWriter, status int, realm string) {
+	if status == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+	}
+	http.Error(rw, http.StatusText(status), status)
+}
+
+type adminPolicyState struct {
+	Policy  string         `json:"policy"`
+	Count   int            `json:"count"`
+	Expires int64          `json:"expires,omitempty"`
+	Banned  bool           `json:"banned"`
+	Reasons map[string]int `json:"reasons,omitempty"`
+	Recent  []Violation    `json:"recent,omitempty"`
+}
+
+// ServeAdmin answers GET <adminPath>?ip=1.2.3.4 (or ?key=<identity> when identityParts is more than the ip)
+// with what we know about that client under every policy.
+func (t *TeapotHackerIsolationPlugin) ServeAdmin(rw http.ResponseWriter, req *http.Request) {
+	if status := t.Admin.Allow(req); status != 0 {
+		refuse(rw, status, "teapot-admin")
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		key = req.URL.Query().Get("ip")
+	}
+	if key == "" {
+		http.Error(rw, "Missing ip or key parameter", http.StatusBadRequest)
+		return
+	}
+	states := []adminPolicyState{}
+	for _, policy := range append([]*Policy{t.DefaultPolicy}, t.Policies...) {
+		found, err := t.getIpViolations(policy.Key(key))
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Storage error: %s", err), http.StatusBadGateway)
+			return
+		}
+		if found.count == 0 {
+			continue
+		}
+		states = append(states, adminPolicyState{
+			Policy:  policy.Name,
+			Count:   found.count,
+			Expires: found.expires,
+			Banned:  policy.IsBanned(found),
+			Reasons: found.reasons,
+			Recent:  found.recent,
+		})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(map[string]any{
+		"key":      key,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+		"policies": states,
+	})
+}
+
+// formatReasons renders reason counts for the debug header: "header:X-Waf=1, status:405=3"
+func formatReasons(reasons map[string]int) string {
+	parts := make([]string, 0, len(reasons))
+	for reason, count := range reasons {
+		parts = append(parts, fmt.Sprintf("%s=%d", reason, count))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,194 @@
+package teapot_hacker_isolation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how much of a login request body we'll read looking for the username
+const maxAuthBodyBytes = 64 * 1024
+
+// AuthTracker counts failed logins on authPaths, per IP and per (hashed) username, separately from other violations.
+// Bans only apply to the login paths, so a stuffed account doesn't lock its owner out of the rest of the site.
+type AuthTracker struct {
+	paths          []string
+	failureCodes   []int
+	failureHeader  string
+	usernameFields []string
+	clearOnSuccess bool
+	ipPolicy       *Policy
+	userPolicy     *Policy
+}
+
+// NewAuthTracker returns nil unless authPaths is set
+func NewAuthTracker(config *Config, defaults *Policy) *AuthTracker {
+	if len(config.AuthPaths) == 0 {
+		return nil
+	}
+	a := &AuthTracker{
+		paths:          config.AuthPaths,
+		failureCodes:   config.AuthFailureStatusCodes,
+		failureHeader:  config.AuthFailureHeader,
+		usernameFields: config.AuthUsernameFields,
+		clearOnSuccess: config.AuthClearOnSuccess,
+	}
+	ipPolicy, userPolicy := *defaults, *defaults
+	ipPolicy.Name, ipPolicy.MinInstances, ipPolicy.ReasonThresholds = "auth", config.AuthMaxFailuresPerIP, nil
+	userPolicy.Name, userPolicy.MinInstances, userPolicy.ReasonThresholds = "auth-user", config.AuthMaxFailuresPerUsername, nil
+	a.ipPolicy, a.userPolicy = &ipPolicy, &userPolicy
+	return a
+}
+
+func (a *AuthTracker) Matches(req *http.Request) bool {
+	for _, prefix := range a.paths {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Username returns the hashed username from a form or JSON body ("" if none), leaving the body intact for next.
+func (a *AuthTracker) Username(req *http.Request) string {
+	if req.Body == nil || req.Method == http.MethodGet {
+		return ""
+	}
+	raw, err := io.ReadAll(io.LimitReader(req.Body, maxAuthBodyBytes))
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(raw), req.Body), req.Body}
+	if err != nil {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	username := ""
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(raw))
+		if err != nil {
+			return ""
+		}
+		for _, field := range a.usernameFields {
+			if username = form.Get(field); username != "" {
+				break
+			}
+		}
+	case "application/json":
+		body := map[string]interface{}{}
+		if json.Unmarshal(raw, &body) != nil {
+			return ""
+		}
+		for _, field := range a.usernameFields {
+			if v, ok := body[field].(string); ok && v != "" {
+				username = v
+				break
+			}
+		}
+	}
+	username = strings.ToLower(strings.TrimSpace(username))
+	if username == "" {
+		return ""
+	}
+	return "user=" + hashIdentityValue(username)
+}
+
+// Failure returns the reason if resp is a failed login, or ""
+func (a *AuthTracker) Failure(resp *http.Response) string {
+	for _, code := range a.failureCodes {
+		if resp.StatusCode == code {
+			return "auth:" + strconv.Itoa(code)
+		}
+	}
+	if a.failureHeader != "" && resp.Header.Get(a.failureHeader) != "" {
+		return "auth:" + a.failureHeader
+	}
+	return ""
+}
+
+type authKey struct {
+	policy *Policy
+	id     string
+}
+
+// keys are the ip and username dimensions, without the username if none was submitted
+func (a *AuthTracker) keys(ip string, user string) []authKey {
+	keys := []authKey{{a.ipPolicy, ip}}
+	if user != "" {
+		keys = append(keys, authKey{a.userPolicy, user})
+	}
+	return keys
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// checkAuthBan blocks the login attempt if the IP or the username is jailed, returns true if it did
+func (t *TeapotHackerIsolationPlugin) checkAuthBan(rw http.ResponseWriter, req *http.Request, ip string, user string) bool {
+	for _, k := range t.Auth.keys(ip, user) {
+		found, err := t.getIpViolations(k.policy.Key(k.id))
+		if err != nil || !k.policy.IsBanned(found) {
+			continue
+		}
+		t.Logger.Infow("login blocked", t.logFields(req, k.id, LogFields{
+			"policy": k.policy.Name, "action": "block", "reason": "jailed", "count": found.count, "expires": found.expires,
+		}))
+		t.Metrics.Inc("teapot_blocked_requests_total", "")
+		t.Block(rw, req, ip, k.policy, found, "jailed")
+		return true
+	}
+	return false
+}
+
+// trackAuthResult counts a failed login against the IP and the username and bans on either,
+// or clears the IP's failures after a success if authClearOnSuccess. Returns true if it blocked.
+func (t *TeapotHackerIsolationPlugin) trackAuthResult(rw http.ResponseWriter, req *http.Request, ip string, user string, resp *http.Response) bool {
+	reason := t.Auth.Failure(resp)
+	if reason == "" {
+		if t.Auth.clearOnSuccess && resp.StatusCode < 400 {
+			if err := t.Storage.ResetIpViolations(t.Auth.ipPolicy.Key(ip)); err != nil {
+				t.Metrics.Inc("teapot_storage_errors_total", "reset")
+			}
+		}
+		return false
+	}
+	t.Metrics.Inc("teapot_violations_total", "auth")
+	violation := Violation{Reason: reason, Path: req.URL.Path, Time: time.Now()}
+	bannedPolicy, bannedId := (*Policy)(nil), ""
+	var bannedFound StorageItem
+	for i, k := range t.Auth.keys(ip, user) {
+		found, err := t.incrIpViolations(k.policy.Key(k.id), k.policy.JailTime(), violation)
+		if err != nil {
+			t.Logger.Errorw("unable to log failed login to storage", t.logFields(req, k.id, LogFields{"policy": k.policy.Name, "error": err}))
+			continue
+		}
+		t.Logger.Debugw("login failure counted", t.logFields(req, k.id, LogFields{
+			"policy": k.policy.Name, "action": "violation", "reason": reason, "count": found.count, "expires": found.expires,
+		}))
+		if i == 0 {
+			t.writeSecurityEvent(req, ip, "violation", reason, found)
+		}
+		if bannedPolicy == nil && k.policy.IsBanned(found) {
+			bannedPolicy, bannedId, bannedFound = k.policy, k.id, found
+		}
+	}
+	if bannedPolicy == nil {
+		return false
+	}
+	t.Logger.Warnw("login is now blocked", t.logFields(req, bannedId, LogFields{
+		"policy": bannedPolicy.Name, "action": "ban", "reason": reason, "count": bannedFound.count, "expires": bannedFound.expires,
+	}))
+	t.Metrics.Inc("teapot_bans_total", "")
+	t.recordBan(req, bannedPolicy.Key(bannedId), reason, bannedFound)
+	t.writeSecurityEvent(req, bannedId, "ban", reason, bannedFound)
+	t.notifyWebhooks(req, bannedId, bannedPolicy, "ban", reason, bannedFound)
+	t.Metrics.Inc("teapot_blocked_requests_total", "")
+	t.Block(rw, req, ip, bannedPolicy, bannedFound, reason)
+	return true
+}
@@ -0,0 +1,75 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAuthFailureTracking(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.AuthPaths = []string{"/login"}
+	config.AuthMaxFailuresPerIP = 3
+	config.AuthMaxFailuresPerUsername = 2
+	config.AuthClearOnSuccess = true
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(ip string, contentType string, body string) int {
+		return ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/login", ip, body, "Content-Type", contentType).Code
+	}
+	form := "application/x-www-form-urlencoded"
+
+	// credential stuffing one account from rotating ips
+	login("10.0.0.1", form, "username=victim&password=a")
+	if code := login("10.0.0.2", "application/json", `{"email": "Victim", "password": "b"}`); code != 418 {
+		t.Errorf("Expected the second failure for the same username to ban it, got %d", code)
+	}
+	if code := login("10.0.0.3", form, "username=victim&password=hunter2"); code != 418 {
+		t.Errorf("Expected the jailed username to be blocked from a fresh ip, got %d", code)
+	}
+	if code := login("10.0.0.3", form, "username=someone&password=hunter2"); code != 200 {
+		t.Errorf("Other usernames shouldn't be affected, got %d", code)
+	}
+
+	// a success clears the ip's failures
+	login("10.0.0.4", form, "username=a&password=x")
+	login("10.0.0.4", form, "username=b&password=x")
+	login("10.0.0.4", form, "username=c&password=hunter2")
+	if code := login("10.0.0.4", form, "username=d&password=x"); code != 401 {
+		t.Errorf("Expected the ip's failures to be cleared by the success, got %d", code)
+	}
+	if found, _ := newPlugin.getIpViolations("auth|10.0.0.4"); found.count != 1 {
+		t.Errorf("Expected one failure after the reset, got %d", found.count)
+	}
+}
+
+func TestAuthUsernamesAreCappedPerIP(t *testing.T) {
+	config := CreateTestConfig()
+	config.AuthPaths = []string{"/login"}
+	config.AuthMaxFailuresPerIP = 3
+	config.AuthMaxFailuresPerUsername = 2
+	newPlugin, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every username is a new storage key, but a jailed ip can't submit any more of them
+	for i := 0; i < 20; i++ {
+		ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/login", "10.0.0.1", "username=u"+strconv.Itoa(i)+"&password=x",
+			"Content-Type", "application/x-www-form-urlencoded")
+	}
+	users := 0
+	for key := range newPlugin.Storage.(*MemoryStorage).live() {
+		if strings.HasPrefix(key, "auth-user|") {
+			users++
+		}
+	}
+	if users != config.AuthMaxFailuresPerIP {
+		t.Errorf("Expected at most %d usernames tracked for one ip, got %d", config.AuthMaxFailuresPerIP, users)
+	}
+}
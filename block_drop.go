@@ -0,0 +1,37 @@
+package teapot_hacker_isolation
+
+import (
+	"net"
+	"net/http"
+)
+
+// DropConnection is the drop block action: no status, no body, the connection just goes away.
+// HTTP/1.x connections are hijacked and closed (with a TCP RST if dropWithReset is set), HTTP/2
+// streams are reset by aborting the handler, anything else falls back to ReturnHackerResponse.
+func (t *TeapotHackerIsolationPlugin) DropConnection(rw http.ResponseWriter, req *http.Request, policy *Policy, found StorageItem, reason string) {
+	if req.ProtoMajor >= 2 {
+		t.Metrics.Inc("teapot_dropped_connections_total", "abort")
+		// net/http turns this into RST_STREAM for HTTP/2 and doesn't log it
+		panic(http.ErrAbortHandler)
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		t.Metrics.Inc("teapot_dropped_connections_total", "fallback")
+		t.ReturnHackerResponse(rw, req, policy, found, reason)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		t.Logger.Debugw("unable to hijack connection, responding instead", LogFields{"error": err, "path": req.URL.Path})
+		t.Metrics.Inc("teapot_dropped_connections_total", "fallback")
+		t.ReturnHackerResponse(rw, req, policy, found, reason)
+		return
+	}
+	if t.Config.DropWithReset {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0) // close sends RST instead of FIN
+		}
+	}
+	conn.Close()
+	t.Metrics.Inc("teapot_dropped_connections_total", "closed")
+}
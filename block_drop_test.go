@@ -0,0 +1,79 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropConnection(t *testing.T) {
+	config := CreateTestConfig()
+	config.BlockAction = "drop"
+	config.DropWithReset = true
+	newPlugin, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := StorageItem{count: 2, expires: time.Now().Unix() + 60}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		newPlugin.Block(rw, req, "127.0.0.1", newPlugin.DefaultPolicy, found, "jailed")
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected the connection to be dropped, got status %d", resp.StatusCode)
+	}
+
+	// httptest.ResponseRecorder can't be hijacked, so we get the normal block response
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/innocent", nil)
+	newPlugin.Block(recorder, req, "0.1.2.3", newPlugin.DefaultPolicy, found, "jailed")
+	if recorder.Code != 418 {
+		t.Errorf("Expected fallback to a 418, got %d", recorder.Code)
+	}
+}
+
+func TestDropConnectionResetsHttp2Stream(t *testing.T) {
+	config := CreateTestConfig()
+	config.BlockAction = "drop"
+	newPlugin, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := StorageItem{count: 2, expires: time.Now().Unix() + 60}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/innocent" {
+			return
+		}
+		newPlugin.Block(rw, req, "127.0.0.1", newPlugin.DefaultPolicy, found, "jailed")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	client := server.Client()
+
+	resp, err := client.Get(server.URL + "/jailed")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected the stream to be reset, got status %d over %s", resp.StatusCode, resp.Proto)
+	}
+	if !strings.Contains(err.Error(), "stream error") {
+		t.Errorf("Expected an HTTP/2 stream reset, got %s", err)
+	}
+
+	// only the stream is reset, the connection stays usable
+	resp, err = client.Get(server.URL + "/innocent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 over HTTP/2, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+}
@@ -0,0 +1,96 @@
+package teapot_hacker_isolation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// BlockRedirect sends blocked browsers to an explanation / appeal page.
+type BlockRedirect struct {
+	target     *url.URL
+	statusCode int
+	secret     []byte
+}
+
+func NewBlockRedirect(config *Config) (*BlockRedirect, error) {
+	if config.RedirectURL == "" {
+		return nil, fmt.Errorf("blockAction redirect requires redirectUrl")
+	}
+	if config.RedirectSecret == "" {
+		return nil, fmt.Errorf("blockAction redirect requires redirectSecret")
+	}
+	target, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("redirectUrl: %w", err)
+	}
+	statusCode := config.RedirectStatusCode
+	switch statusCode {
+	case 0:
+		statusCode = http.StatusFound
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+	default:
+		return nil, fmt.Errorf("redirectStatusCode %d must be 302, 303 or 307", statusCode)
+	}
+	return &BlockRedirect{target: target, statusCode: statusCode, secret: []byte(config.RedirectSecret)}, nil
+}
+
+// IsTarget is the loop guard: requests for the appeal page itself are never blocked.
+func (r *BlockRedirect) IsTarget(req *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	if r.target.Host != "" && !strings.EqualFold(r.target.Host, req.Host) {
+		return false
+	}
+	path := r.target.Path
+	if path == "" {
+		path = "/"
+	}
+	return req.URL.Path == path
+}
+
+// Location builds the signed redirect target for a blocked client.
+func (r *BlockRedirect) Location(ip string, ref string, expires int64, reason string) string {
+	query := r.target.Query()
+	query.Set("ip", ip)
+	query.Set("ref", ref)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("reason", reason)
+	query.Set("sig", SignRedirect(r.secret, ip, ref, expires, reason))
+	location := *r.target
+	location.RawQuery = query.Encode()
+	return location.String()
+}
+
+// SignRedirect is the hex HMAC-SHA256 of ip, ref, expires and reason, each written as "<length>:<value>" so
+// no field can spill into the next (ref comes from the client's X-Request-Id). Appeal pages recompute it to detect forgeries.
+func SignRedirect(secret []byte, ip string, ref string, expires int64, reason string) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, field := range []string{ip, ref, strconv.FormatInt(expires, 10), reason} {
+		mac.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRedirect checks the query string of an appeal page request.
+func VerifyRedirect(secret []byte, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return false
+	}
+	expected := SignRedirect(secret, query.Get("ip"), query.Get("ref"), expires, query.Get("reason"))
+	return hmac.Equal([]byte(expected), []byte(query.Get("sig")))
+}
+
+// RedirectResponse is the redirect block action.
+func (t *TeapotHackerIsolationPlugin) RedirectResponse(rw http.ResponseWriter, req *http.Request, ip string, policy *Policy, found StorageItem, reason string) {
+	t.AppendStatusHeaders(rw, policy, found, true)
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Redirect(rw, req, t.Redirect.Location(ip, RequestID(req), found.expires, reason), t.Redirect.statusCode)
+}
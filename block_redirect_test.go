@@ -0,0 +1,58 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRedirectBlockAction(t *testing.T) {
+	config := CreateTestConfig()
+	config.BlockAction = "redirect"
+	config.RedirectURL = "/blocked?lang=en"
+	config.RedirectSecret = "s3cret"
+	newPlugin, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := StorageItem{count: 2, expires: time.Now().Unix() + 60}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/innocent", nil)
+	req.RemoteAddr = "0.1.2.3:666"
+	newPlugin.Block(recorder, req, "0.1.2.3", newPlugin.DefaultPolicy, found, "status")
+	if recorder.Code != 302 {
+		t.Fatalf("Expected a 302, got %d", recorder.Code)
+	}
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil || location.Path != "/blocked" || location.Query().Get("lang") != "en" {
+		t.Fatalf("Unexpected Location %q", recorder.Header().Get("Location"))
+	}
+	if !VerifyRedirect([]byte("s3cret"), location.Query()) {
+		t.Error("Redirect signature didn't verify")
+	}
+	forged := location.Query()
+	forged.Set("expires", "9999999999")
+	if VerifyRedirect([]byte("s3cret"), forged) {
+		t.Error("Forged redirect verified")
+	}
+
+	// a ref carrying the other fields must not sign a different expiry
+	smuggled := url.Values{"ip": {"0.1.2.3"}, "ref": {"R|9999999999|x"}, "expires": {"1"}, "reason": {"status"}}
+	smuggled.Set("sig", SignRedirect([]byte("s3cret"), "0.1.2.3", "R|9999999999|x", 1, "status"))
+	shifted := url.Values{"ip": {"0.1.2.3"}, "ref": {"R"}, "expires": {"9999999999"}, "reason": {"x|1|status"}, "sig": {smuggled.Get("sig")}}
+	if !VerifyRedirect([]byte("s3cret"), smuggled) || VerifyRedirect([]byte("s3cret"), shifted) {
+		t.Error("Redirect signature fields must not run into each other")
+	}
+
+	// the appeal page itself is never blocked, even for a jailed IP
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "")
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "")
+	recorder = ServeTestRequest(newPlugin, http.MethodGet, "http://localhost"+location.String(), "0.1.2.3", "")
+	if recorder.Code != 200 {
+		t.Errorf("Appeal page should not be blocked, got %d", recorder.Code)
+	}
+}
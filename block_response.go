@@ -0,0 +1,194 @@
+package teapot_hacker_isolation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// BlockTemplateConfig is one variant of the block response body, selected by the request's Accept header.
+type BlockTemplateConfig struct {
+	ContentType  string `json:"contentType"`
+	Template     string `json:"template"`
+	TemplateFile string `json:"templateFile"`
+}
+
+// BlockTemplateData is what block templates can use.
+type BlockTemplateData struct {
+	IP          string
+	Count       int
+	Expires     time.Time
+	ExpiresUnix int64
+	Reason      string
+	RequestID   string
+	Status      int
+	StatusText  string
+	Method      string
+	Host        string
+	Path        string
+	Policy      string
+}
+
+var defaultBlockTemplates = []BlockTemplateConfig{
+	{ContentType: "text/html", Template: `<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body><h1>{{.StatusText}}</h1>
+<p>Your address {{.IP}} has been blocked until {{.Expires.UTC.Format "2006-01-02 15:04:05 MST"}}.</p>
+<p>Reference: {{.RequestID}}</p></body></html>
+`},
+	{ContentType: "application/json", Template: `{"error":"blocked","status":{{.Status}},"ip":{{json .IP}},"count":{{.Count}},"reason":{{json .Reason}},"expires":{{json .Expires}},"requestId":{{json .RequestID}}}`},
+	{ContentType: "application/problem+json", Template: `{"type":"about:blank","title":{{json .StatusText}},"status":{{.Status}},"detail":{{json (printf "%s is blocked until %s" .IP (.Expires.UTC.Format "2006-01-02T15:04:05Z07:00"))}},"instance":{{json .Path}},"requestId":{{json .RequestID}},"reason":{{json .Reason}},"count":{{.Count}}}`},
+	{ContentType: "text/plain", Template: "Blocked: {{.IP}} until {{.Expires.UTC.Format \"2006-01-02T15:04:05Z07:00\"}} (reference {{.RequestID}})\n"},
+}
+
+type blockVariant struct {
+	contentType string
+	mediaType   string
+	execute     func(buf *bytes.Buffer, data BlockTemplateData) error
+}
+
+// BlockResponder renders the configured block body variants.
+type BlockResponder struct {
+	variants []blockVariant
+}
+
+var blockTemplateFuncs = map[string]any{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// NewBlockResponder compiles the configured templates, returns nil when none are configured (static blockedBody is used).
+func NewBlockResponder(config *Config) (*BlockResponder, error) {
+	configs := config.BlockedTemplates
+	if config.BlockedTemplatesDefaults {
+		configs = append(append([]BlockTemplateConfig{}, configs...), defaultBlockTemplates...)
+	}
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	r := &BlockResponder{}
+	for i, c := range configs {
+		source := c.Template
+		if c.TemplateFile != "" {
+			data, err := os.ReadFile(c.TemplateFile)
+			if err != nil {
+				return nil, fmt.Errorf("block template %d: %w", i, err)
+			}
+			source = string(data)
+		}
+		if c.ContentType == "" {
+			return nil, fmt.Errorf("block template %d has no contentType", i)
+		}
+		mediaType, _, err := mime.ParseMediaType(c.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("block template %d: %w", i, err)
+		}
+		variant := blockVariant{contentType: c.ContentType, mediaType: mediaType}
+		name := fmt.Sprintf("block%d", i)
+		if mediaType == "text/html" {
+			tmpl, err := htmltemplate.New(name).Funcs(blockTemplateFuncs).Parse(source)
+			if err != nil {
+				return nil, fmt.Errorf("block template %d: %w", i, err)
+			}
+			variant.execute = func(buf *bytes.Buffer, data BlockTemplateData) error { return tmpl.Execute(buf, data) }
+		} else {
+			tmpl, err := texttemplate.New(name).Funcs(blockTemplateFuncs).Parse(source)
+			if err != nil {
+				return nil, fmt.Errorf("block template %d: %w", i, err)
+			}
+			variant.execute = func(buf *bytes.Buffer, data BlockTemplateData) error { return tmpl.Execute(buf, data) }
+		}
+		r.variants = append(r.variants, variant)
+	}
+	return r, nil
+}
+
+// Render picks the variant best matching accept (first configured one if nothing matches) and executes it.
+func (r *BlockResponder) Render(accept string, data BlockTemplateData) (string, []byte, error) {
+	variant := r.negotiate(accept)
+	buf := bytes.Buffer{}
+	err := variant.execute(&buf, data)
+	return variant.contentType, buf.Bytes(), err
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func (r *BlockResponder) negotiate(accept string) blockVariant {
+	ranges := parseAccept(accept)
+	for _, ar := range ranges {
+		if ar.q <= 0 {
+			continue
+		}
+		for _, v := range r.variants {
+			if mediaTypeMatches(ar.mediaType, v.mediaType) {
+				return v
+			}
+		}
+	}
+	return r.variants[0]
+}
+
+func mediaTypeMatches(pattern string, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// parseAccept returns the Accept header's ranges, best first (by q, then specificity, then order)
+func parseAccept(accept string) []acceptRange {
+	ranges := []acceptRange{}
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return strings.Count(ranges[i].mediaType, "*") < strings.Count(ranges[j].mediaType, "*")
+	})
+	return ranges
+}
+
+// RequestID returns the incoming X-Request-Id (if any) so block pages can be correlated, or a random one.
+func RequestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
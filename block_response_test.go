@@ -0,0 +1,48 @@
+package teapot_hacker_isolation
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockResponderNegotiation(t *testing.T) {
+	config := CreateTestConfig()
+	config.BlockedTemplatesDefaults = true
+	responder, err := NewBlockResponder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := BlockTemplateData{IP: "0.1.2.3", Count: 2, Expires: time.Unix(1714567000, 0), Reason: "status", RequestID: "abc", Status: 418, StatusText: "I'm a teapot", Path: "/x"}
+
+	expected := map[string]string{
+		"":                                    "text/html",
+		"text/html,application/xhtml+xml,*/*": "text/html",
+		"application/json":                    "application/json",
+		"application/problem+json, application/json;q=0.5": "application/problem+json",
+		"text/*;q=0.9, application/json;q=0.1":             "text/html",
+		"text/plain":                                       "text/plain",
+		"image/png":                                        "text/html",
+	}
+	for accept, want := range expected {
+		contentType, body, err := responder.Render(accept, data)
+		if err != nil {
+			t.Fatalf("%s: %s", accept, err)
+		}
+		if contentType != want {
+			t.Errorf("Accept %q: expected %s, got %s", accept, want, contentType)
+		}
+		if strings.HasSuffix(contentType, "json") {
+			var parsed map[string]any
+			if err := json.Unmarshal(body, &parsed); err != nil {
+				t.Errorf("Accept %q: body isn't valid JSON: %s", accept, body)
+			}
+		}
+	}
+
+	config.BlockedTemplates = []BlockTemplateConfig{{ContentType: "text/plain", Template: "{{.Nope"}}
+	if _, err := NewBlockResponder(config); err == nil {
+		t.Error("Expected a template parse error")
+	}
+}
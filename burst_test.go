@@ -0,0 +1,44 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotFoundBurst(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.MinInstances = 5
+	config.BurstDistinctPaths = 3
+	config.BurstWeight = 5
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same bad bookmark over and over is not a burst
+	for i := 0; i < 5; i++ {
+		if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/404-please", "0.1.2.3", "").Code; code != 404 {
+			t.Fatalf("Expected 404 for a repeated path, got %d", code)
+		}
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/404-please/admin", "0.1.2.3", "").Code; code != 404 {
+		t.Fatalf("Two distinct paths aren't a burst yet, got %d", code)
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/404-please/.git/config", "0.1.2.3", "").Code; code != 418 {
+		t.Errorf("Expected the third distinct path to ban, got %d", code)
+	}
+	if found, _ := newPlugin.getIpViolations("0.1.2.3"); found.reasons["burst:404"] != 5 {
+		t.Errorf("Expected one burst violation of weight 5, got %v", found.reasons)
+	}
+
+	memory := NewMemoryStorage()
+	for i := 0; i < maxDistinctMembers+10; i++ {
+		memory.TrackDistinct("key", "/"+strconv.Itoa(i), time.Minute)
+	}
+	if count, _ := memory.TrackDistinct("key", "/more", time.Minute); count != maxDistinctMembers {
+		t.Errorf("Expected distinct tracking to saturate at %d, got %d", maxDistinctMembers, count)
+	}
+}
@@ -0,0 +1,269 @@
+package teapot_hacker_isolation
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long an issued puzzle stays solvable
+const challengeMaxAge = 10 * time.Minute
+
+// Challenge is the soft block tier: a hashcash-style proof-of-work puzzle for browsers whose
+// violation count crossed challengeThreshold, solved puzzles earn a signed, IP-bound pass cookie.
+type Challenge struct {
+	secret     []byte
+	difficulty int
+	threshold  int
+	cookieName string
+	cookieTTL  time.Duration
+	path       string
+	reset      bool
+}
+
+func NewChallenge(config *Config) (*Challenge, error) {
+	if config.ChallengeSecret == "" {
+		return nil, fmt.Errorf("challengeThreshold requires challengeSecret")
+	}
+	if config.ChallengeThreshold >= config.MinInstances {
+		return nil, fmt.Errorf("challengeThreshold (%d) must be lower than minInstances (%d)", config.ChallengeThreshold, config.MinInstances)
+	}
+	c := &Challenge{
+		secret:     []byte(config.ChallengeSecret),
+		difficulty: config.ChallengeDifficulty,
+		threshold:  config.ChallengeThreshold,
+		cookieName: config.ChallengeCookieName,
+		cookieTTL:  time.Duration(config.ChallengeCookieTTLSeconds) * time.Second,
+		path:       config.ChallengePath,
+		reset:      config.ChallengeResetCount,
+	}
+	if c.difficulty <= 0 || c.difficulty > 32 {
+		return nil, fmt.Errorf("challengeDifficulty %d must be between 1 and 32", c.difficulty)
+	}
+	if c.cookieName == "" {
+		c.cookieName = "teapot_pass"
+	}
+	if c.cookieTTL <= 0 {
+		c.cookieTTL = time.Hour
+	}
+	if c.path == "" {
+		c.path = "/.teapot/challenge"
+	}
+	return c, nil
+}
+
+func (c *Challenge) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a new stateless puzzle for ip: "<issued>.<random>.<fingerprint>.<hmac>". The fingerprint
+// key (if any) of the page that was challenged travels along, the solution POST doesn't look the same.
+func (c *Challenge) Issue(ip string, fingerprint string) string {
+	random := make([]byte, 12)
+	rand.Read(random)
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := base64.RawURLEncoding.EncodeToString(random)
+	fp := strings.TrimPrefix(fingerprint, "fp=")
+	return issued + "." + nonce + "." + fp + "." + c.sign("challenge", ip, issued, nonce, fp)
+}
+
+// VerifySolution checks the puzzle was issued to ip recently and that sha256(puzzle + ":" + solution)
+// starts with at least difficulty zero bits.
+func (c *Challenge) VerifySolution(ip string, puzzle string, solution string) bool {
+	parts := strings.Split(puzzle, ".")
+	if len(parts) != 4 {
+		return false
+	}
+	if !hmac.Equal([]byte(parts[3]), []byte(c.sign("challenge", ip, parts[0], parts[1], parts[2]))) {
+		return false
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Since(time.Unix(issued, 0)) > challengeMaxAge {
+		return false
+	}
+	sum := sha256.Sum256([]byte(puzzle + ":" + solution))
+	return leadingZeroBits(sum[:]) >= c.difficulty
+}
+
+// Spend marks the (already verified) puzzle as used, false means it was solved before. Spent puzzles are kept in
+// storage for challengeMaxAge (as a one-per-window rate key), so replays are refused across instances too.
+func (c *Challenge) Spend(storage IStorage, puzzle string) (bool, error) {
+	parts := strings.Split(puzzle, ".")
+	if len(parts) != 4 {
+		return false, nil
+	}
+	return storage.AllowRate("challenge:"+parts[1], challengeMaxAge, 1)
+}
+
+// PuzzleFingerprint is the fingerprint key the (already verified) puzzle was issued for, or ""
+func PuzzleFingerprint(puzzle string) string {
+	parts := strings.Split(puzzle, ".")
+	if len(parts) != 4 || parts[2] == "" {
+		return ""
+	}
+	return "fp=" + parts[2]
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, v := range b {
+		if v == 0 {
+			n += 8
+			continue
+		}
+		return n + bits.LeadingZeros8(v)
+	}
+	return n
+}
+
+// PassCookie returns the cookie granted for a solved puzzle, bound to ip.
+func (c *Challenge) PassCookie(ip string) *http.Cookie {
+	expires := time.Now().Add(c.cookieTTL)
+	e := strconv.FormatInt(expires.Unix(), 10)
+	return &http.Cookie{
+		Name:     c.cookieName,
+		Value:    e + "." + c.sign("pass", ip, e),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (c *Challenge) HasValidPass(req *http.Request, ip string) bool {
+	cookie, err := req.Cookie(c.cookieName)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(c.sign("pass", ip, parts[0]))) {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
+
+func wantsHtml(req *http.Request) bool {
+	for _, ar := range parseAccept(req.Header.Get("Accept")) {
+		if ar.mediaType == "text/html" && ar.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+var challengePage = htmltemplate.Must(htmltemplate.New("challenge").Parse(`<!DOCTYPE html>
+<html><head><title>Checking your browser</title><meta name="robots" content="noindex"></head>
+<body><p id="status">Checking your browser, this only takes a moment&hellip;</p>
+<form id="solution" method="POST" action="{{.Path}}">
+<input type="hidden" name="challenge" value="{{.Puzzle}}">
+<input type="hidden" name="solution" value="">
+<input type="hidden" name="return" value="{{.Return}}">
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+</form>
+<script>
+(async function() {
+  const form = document.getElementById("solution");
+  const puzzle = form.challenge.value, difficulty = {{.Difficulty}}, encoder = new TextEncoder();
+  for (let n = 0; ; n++) {
+    const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(puzzle + ":" + n)));
+    let zeros = 0;
+    for (const b of hash) {
+      if (b === 0) { zeros += 8; continue; }
+      zeros += Math.clz32(b) - 24;
+      break;
+    }
+    if (zeros >= difficulty) {
+      form.solution.value = String(n);
+      form.submit();
+      return;
+    }
+  }
+})();
+</script></body></html>
+`))
+
+// handleChallenge returns true if it answered the request (puzzle page or solution check).
+func (t *TeapotHackerIsolationPlugin) handleChallenge(rw http.ResponseWriter, req *http.Request, ip string, identities []string, policy *Policy, found StorageItem) bool {
+	c := t.Challenge
+	identity := identities[0]
+	if req.URL.Path == c.path && req.Method == http.MethodPost {
+		req.ParseForm()
+		puzzle := req.PostForm.Get("challenge")
+		// only clients that are actually being challenged may solve one, and each puzzle only once
+		valid := found.count >= c.threshold && c.VerifySolution(ip, puzzle, req.PostForm.Get("solution"))
+		if valid {
+			spent, err := c.Spend(t.Storage, puzzle)
+			if err != nil {
+				t.Metrics.Inc("teapot_storage_errors_total", "rate")
+				t.Logger.Errorw("unable to record solved challenge", t.logFields(req, identity, LogFields{"error": err}))
+			}
+			valid = spent && err == nil
+		}
+		if !valid {
+			t.Metrics.Inc("teapot_challenges_total", "failed")
+			http.Error(rw, "Invalid or expired challenge solution", http.StatusForbidden)
+			return true
+		}
+		t.Metrics.Inc("teapot_challenges_total", "solved")
+		t.Logger.Infow("challenge solved", t.logFields(req, identity, LogFields{"action": "challenge-solved", "count": found.count}))
+		if c.reset {
+			reset := []string{identity}
+			if fp := PuzzleFingerprint(puzzle); fp != "" {
+				reset = append(reset, fp)
+			}
+			// the puzzle was earned on whatever page the policies protect, not on the solution path
+			for _, p := range append([]*Policy{t.DefaultPolicy}, t.Policies...) {
+				for _, id := range reset {
+					if err := t.Storage.ResetIpViolations(p.Key(id)); err != nil {
+						t.Metrics.Inc("teapot_storage_errors_total", "reset")
+						t.Logger.Errorw("unable to reset violations", t.logFields(req, id, LogFields{"policy": p.Name, "error": err}))
+					}
+				}
+			}
+		}
+		http.SetCookie(rw, c.PassCookie(ip))
+		http.Redirect(rw, req, safeReturnPath(req.PostForm.Get("return")), http.StatusSeeOther)
+		return true
+	}
+	if found.count < c.threshold || c.HasValidPass(req, ip) || !wantsHtml(req) {
+		return false // non-browsers keep going, and keep accumulating violations
+	}
+	fingerprint := ""
+	if len(identities) > 1 {
+		fingerprint = identities[1]
+	}
+	t.Metrics.Inc("teapot_challenges_total", "issued")
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	t.AppendStatusHeaders(rw, policy, found, false)
+	rw.WriteHeader(http.StatusForbidden)
+	challengePage.Execute(rw, map[string]any{
+		"Path":       c.path,
+		"Puzzle":     c.Issue(ip, fingerprint),
+		"Difficulty": c.difficulty,
+		"Return":     req.URL.RequestURI(),
+	})
+	return true
+}
+
+// safeReturnPath only allows local paths, so the solution form can't be used as an open redirect
+func safeReturnPath(ret string) string {
+	u, err := url.Parse(ret)
+	if err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(ret, "//") {
+		return "/"
+	}
+	return ret
+}
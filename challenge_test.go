@@ -0,0 +1,121 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestChallengeSoftBlock(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.MinInstances = 3
+	config.ChallengeThreshold = 1
+	config.ChallengeDifficulty = 8
+	config.ChallengeSecret = "s3cret"
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "", "Accept", testBrowserAccept)
+
+	// browsers get the puzzle, API clients pass through
+	recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "0.1.2.3", "", "Accept", testBrowserAccept)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "crypto.subtle") {
+		t.Fatalf("Expected the challenge page, got %d", recorder.Code)
+	}
+	apiRecorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "0.1.2.3", "", "Accept", "application/json")
+	if apiRecorder.Code != 200 {
+		t.Errorf("Non-browser clients shouldn't be challenged, got %d", apiRecorder.Code)
+	}
+
+	puzzle := regexp.MustCompile(`name="challenge" value="([^"]+)"`).FindStringSubmatch(recorder.Body.String())[1]
+	solution := 0
+	for ; !newPlugin.Challenge.VerifySolution("0.1.2.3", puzzle, strconv.Itoa(solution)); solution++ {
+	}
+
+	form := url.Values{"challenge": {puzzle}, "solution": {strconv.Itoa(solution)}, "return": {"/innocent"}}
+	recorder = ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/.teapot/challenge", "0.1.2.3", form.Encode(),
+		"Accept", testBrowserAccept, "Content-Type", "application/x-www-form-urlencoded")
+	if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != "/innocent" {
+		t.Fatalf("Expected a redirect back, got %d %s", recorder.Code, recorder.Header().Get("Location"))
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatal("Expected a pass cookie")
+	}
+	if found, _ := newPlugin.Storage.GetIpViolations("0.1.2.3"); found.count != 0 {
+		t.Errorf("Solving the challenge should reset the count, got %d", found.count)
+	}
+
+	// the cookie only works for the IP it was issued to
+	if !newPlugin.Challenge.HasValidPass(withCookie(httptest.NewRequest(http.MethodGet, "http://localhost/", nil), cookies[0]), "0.1.2.3") {
+		t.Error("Pass cookie should be valid")
+	}
+	if newPlugin.Challenge.HasValidPass(withCookie(httptest.NewRequest(http.MethodGet, "http://localhost/", nil), cookies[0]), "0.1.2.4") {
+		t.Error("Pass cookie should be bound to the IP")
+	}
+}
+
+const testBrowserAccept = "text/html,*/*;q=0.8"
+
+func withCookie(req *http.Request, cookie *http.Cookie) *http.Request {
+	req.AddCookie(cookie)
+	return req
+}
+
+func TestChallengeCannotBeReplayed(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.MinInstances = 3
+	config.ChallengeThreshold = 1
+	config.ChallengeDifficulty = 8
+	config.ChallengeSecret = "s3cret"
+	config.Fingerprint = true
+	config.FingerprintTlsHeader = "X-JA3-Hash"
+	config.FingerprintMinInstances = 100
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browsing := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	browsing.Header.Set("Accept", testBrowserAccept)
+	fingerprint := newPlugin.Fingerprint.Key(browsing)
+
+	puzzle := newPlugin.Challenge.Issue("0.1.2.3", fingerprint)
+	solution := 0
+	for ; !newPlugin.Challenge.VerifySolution("0.1.2.3", puzzle, strconv.Itoa(solution)); solution++ {
+	}
+	form := url.Values{"challenge": {puzzle}, "solution": {strconv.Itoa(solution)}}.Encode()
+	solve := func() int {
+		return ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/.teapot/challenge", "0.1.2.3", form,
+			"Accept", testBrowserAccept, "Content-Type", "application/x-www-form-urlencoded").Code
+	}
+
+	// a solution from a client that isn't being challenged is refused, and doesn't use up the puzzle
+	if code := solve(); code != http.StatusForbidden {
+		t.Errorf("Expected a 403 below challengeThreshold, got %d", code)
+	}
+
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "", "Accept", testBrowserAccept)
+	if code := solve(); code != http.StatusSeeOther {
+		t.Fatalf("Expected the solution to be accepted, got %d", code)
+	}
+	if found, _ := newPlugin.Storage.GetIpViolations(newPlugin.DefaultPolicy.Key(fingerprint)); found.count != 0 {
+		t.Errorf("Solving the challenge should reset the fingerprint too, got %d", found.count)
+	}
+
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "", "Accept", testBrowserAccept)
+	if code := solve(); code != http.StatusForbidden {
+		t.Errorf("Expected a replayed solution to be refused, got %d", code)
+	}
+	if found, _ := newPlugin.Storage.GetIpViolations("0.1.2.3"); found.count != 1 {
+		t.Errorf("A replayed solution shouldn't reset the count, got %d", found.count)
+	}
+}
@@ -0,0 +1,517 @@
+package teapot_hacker_isolation
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleConfig is a custom trigger written in a small expression language, e.g.
+// `status == 418 && method == "POST" && path startsWith "/api/" && !(header("User-Agent") contains "our-sdk")`
+type RuleConfig struct {
+	Name   string `json:"name"`
+	When   string `json:"when"`
+	Weight int    `json:"weight"`
+}
+
+// Rule is a compiled RuleConfig. Rules only using request fields run before next, the rest after it.
+type Rule struct {
+	Name         string
+	Weight       int
+	PostResponse bool
+	expr         exprNode
+}
+
+// exprContext is what a rule is evaluated against, resp is nil for pre-request rules
+type exprContext struct {
+	req     *http.Request
+	ip      string
+	resp    *http.Response
+	latency time.Duration
+	size    int
+}
+
+// fields and their types, response fields make a rule post-response
+var exprFields = map[string]string{
+	"method":  "string",
+	"path":    "string",
+	"query":   "string",
+	"host":    "string",
+	"ip":      "string",
+	"status":  "number",
+	"latency": "number", // milliseconds
+	"size":    "number", // response body bytes
+}
+
+var exprResponseFields = map[string]bool{"status": true, "latency": true, "size": true, "respHeader": true}
+
+// functions take one argument, these return a string
+var exprFunctions = map[string]string{
+	"header":     "string", // request header
+	"respHeader": "string", // response header
+	"param":      "string", // query parameter
+	"lower":      "string",
+}
+
+func CompileRule(rc RuleConfig) (*Rule, error) {
+	if rc.Name == "" {
+		return nil, fmt.Errorf("every rule needs a name")
+	}
+	p := &exprParser{rule: rc.Name}
+	if err := p.tokenize(rc.When); err != nil {
+		return nil, err
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != "eof" {
+		return nil, p.errorf(p.peek(), "unexpected %q", p.peek().text)
+	}
+	if node.typ() != "bool" {
+		return nil, fmt.Errorf("rule %s: expression must be true or false, not a %s", rc.Name, node.typ())
+	}
+	return &Rule{Name: rc.Name, Weight: rc.Weight, PostResponse: p.postResponse, expr: node}, nil
+}
+
+func (r *Rule) Matches(ctx *exprContext) bool {
+	v, _ := r.expr.eval(ctx).(bool)
+	return v
+}
+
+type exprToken struct {
+	kind string // ident, string, number, op, eof
+	text string
+	pos  int
+}
+
+type exprParser struct {
+	rule         string
+	tokens       []exprToken
+	next         int
+	postResponse bool
+}
+
+func (p *exprParser) errorf(tok exprToken, format string, args ...interface{}) error {
+	return fmt.Errorf("rule %s: column %d: %s", p.rule, tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) tokenize(src string) error {
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			sb := strings.Builder{}
+			i++
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return p.errorf(exprToken{pos: start}, "unterminated string")
+			}
+			i++
+			p.tokens = append(p.tokens, exprToken{kind: "string", text: sb.String(), pos: start})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: "number", text: src[start:i], pos: start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: "ident", text: src[start:i], pos: start})
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return p.errorf(exprToken{pos: i}, "unexpected character %q", c)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, exprToken{kind: "eof", text: "end of expression", pos: len(src)})
+	return nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) take() exprToken {
+	tok := p.tokens[p.next]
+	if tok.kind != "eof" {
+		p.next++
+	}
+	return tok
+}
+
+func (p *exprParser) expect(text string) error {
+	if tok := p.take(); tok.text != text || tok.kind == "string" {
+		return p.errorf(tok, "expected %q, got %q", text, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "op" && p.peek().text == "||" {
+		tok := p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ() != "bool" || right.typ() != "bool" {
+			return nil, p.errorf(tok, "|| needs true/false on both sides")
+		}
+		left = &logicNode{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "op" && p.peek().text == "&&" {
+		tok := p.take()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ() != "bool" || right.typ() != "bool" {
+			return nil, p.errorf(tok, "&& needs true/false on both sides")
+		}
+		left = &logicNode{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.peek().kind == "op" && p.peek().text == "!" {
+		tok := p.take()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if inner.typ() != "bool" {
+			return nil, p.errorf(tok, "! needs true/false")
+		}
+		return &notNode{inner: inner}, nil
+	}
+	return p.parseComparison()
+}
+
+var exprComparisons = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"contains": true, "startsWith": true, "endsWith": true, "matches": true, "in": true,
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if (tok.kind != "op" && tok.kind != "ident") || !exprComparisons[tok.text] {
+		return left, nil
+	}
+	p.take()
+	if tok.text == "in" {
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.items {
+			if item.typ() != left.typ() {
+				return nil, p.errorf(tok, "in list mixes %s and %s", left.typ(), item.typ())
+			}
+		}
+		return &inNode{left: left, list: list}, nil
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	node := &compareNode{op: tok.text, left: left, right: right}
+	switch tok.text {
+	case "==", "!=":
+		if left.typ() != right.typ() {
+			return nil, p.errorf(tok, "can't compare %s %s %s", left.typ(), tok.text, right.typ())
+		}
+	case "<", "<=", ">", ">=":
+		if left.typ() != "number" || right.typ() != "number" {
+			return nil, p.errorf(tok, "%s needs numbers on both sides", tok.text)
+		}
+	case "matches":
+		lit, ok := right.(*literalNode)
+		if !ok || left.typ() != "string" || lit.typ() != "string" {
+			return nil, p.errorf(tok, "matches needs a string on the left and a regular expression literal on the right")
+		}
+		re, err := regexp.Compile(lit.value.(string))
+		if err != nil {
+			return nil, p.errorf(tok, "invalid regular expression: %v", err)
+		}
+		node.re = re
+	default:
+		if left.typ() != "string" || right.typ() != "string" {
+			return nil, p.errorf(tok, "%s needs strings on both sides", tok.text)
+		}
+	}
+	return node, nil
+}
+
+func (p *exprParser) parseList() (*listNode, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	list := &listNode{}
+	for !(p.peek().kind == "op" && p.peek().text == "]") {
+		if len(list.items) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		tok := p.peek()
+		item, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := item.(*literalNode)
+		if !ok {
+			return nil, p.errorf(tok, "lists can only hold literals")
+		}
+		list.items = append(list.items, lit)
+	}
+	p.take()
+	return list, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.take()
+	switch tok.kind {
+	case "string":
+		return &literalNode{value: tok.text}, nil
+	case "number":
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid number %s", tok.text)
+		}
+		return &literalNode{value: f}, nil
+	case "ident":
+		if tok.text == "true" || tok.text == "false" {
+			return &literalNode{value: tok.text == "true"}, nil
+		}
+		if exprResponseFields[tok.text] {
+			p.postResponse = true
+		}
+		if _, ok := exprFunctions[tok.text]; ok {
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if arg.typ() != "string" {
+				return nil, p.errorf(tok, "%s() needs a string", tok.text)
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return &callNode{fn: tok.text, arg: arg}, nil
+		}
+		if _, ok := exprFields[tok.text]; ok {
+			return &fieldNode{name: tok.text}, nil
+		}
+		return nil, p.errorf(tok, "unknown field %s (known: method, path, query, host, ip, status, latency, size, header(), respHeader(), param(), lower())", tok.text)
+	case "op":
+		if tok.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, p.errorf(tok, "unexpected %q", tok.text)
+}
+
+type exprNode interface {
+	typ() string
+	eval(ctx *exprContext) interface{}
+}
+
+type literalNode struct{ value interface{} }
+
+func (n *literalNode) typ() string {
+	switch n.value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	}
+	return "bool"
+}
+
+func (n *literalNode) eval(ctx *exprContext) interface{} { return n.value }
+
+type fieldNode struct{ name string }
+
+func (n *fieldNode) typ() string { return exprFields[n.name] }
+
+func (n *fieldNode) eval(ctx *exprContext) interface{} {
+	switch n.name {
+	case "method":
+		return ctx.req.Method
+	case "path":
+		return ctx.req.URL.Path
+	case "query":
+		return ctx.req.URL.RawQuery
+	case "host":
+		return ctx.req.Host
+	case "ip":
+		return ctx.ip
+	case "status":
+		if ctx.resp == nil {
+			return float64(0)
+		}
+		return float64(ctx.resp.StatusCode)
+	case "latency":
+		return float64(ctx.latency) / float64(time.Millisecond)
+	case "size":
+		return float64(ctx.size)
+	}
+	return nil
+}
+
+type callNode struct {
+	fn  string
+	arg exprNode
+}
+
+func (n *callNode) typ() string { return exprFunctions[n.fn] }
+
+func (n *callNode) eval(ctx *exprContext) interface{} {
+	arg, _ := n.arg.eval(ctx).(string)
+	switch n.fn {
+	case "header":
+		return ctx.req.Header.Get(arg)
+	case "respHeader":
+		if ctx.resp == nil {
+			return ""
+		}
+		return ctx.resp.Header.Get(arg)
+	case "param":
+		return ctx.req.URL.Query().Get(arg)
+	case "lower":
+		return strings.ToLower(arg)
+	}
+	return ""
+}
+
+type notNode struct{ inner exprNode }
+
+func (n *notNode) typ() string { return "bool" }
+
+func (n *notNode) eval(ctx *exprContext) interface{} {
+	v, _ := n.inner.eval(ctx).(bool)
+	return !v
+}
+
+type logicNode struct {
+	and         bool
+	left, right exprNode
+}
+
+func (n *logicNode) typ() string { return "bool" }
+
+func (n *logicNode) eval(ctx *exprContext) interface{} {
+	left, _ := n.left.eval(ctx).(bool)
+	if left != n.and {
+		return left // short circuit
+	}
+	right, _ := n.right.eval(ctx).(bool)
+	return right
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+	re          *regexp.Regexp
+}
+
+func (n *compareNode) typ() string { return "bool" }
+
+func (n *compareNode) eval(ctx *exprContext) interface{} {
+	left, right := n.left.eval(ctx), n.right.eval(ctx)
+	switch n.op {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	case "matches":
+		return n.re.MatchString(left.(string))
+	case "contains":
+		return strings.Contains(left.(string), right.(string))
+	case "startsWith":
+		return strings.HasPrefix(left.(string), right.(string))
+	case "endsWith":
+		return strings.HasSuffix(left.(string), right.(string))
+	}
+	l, r := left.(float64), right.(float64)
+	switch n.op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+	return l >= r
+}
+
+type listNode struct{ items []*literalNode }
+
+type inNode struct {
+	left exprNode
+	list *listNode
+}
+
+func (n *inNode) typ() string { return "bool" }
+
+func (n *inNode) eval(ctx *exprContext) interface{} {
+	v := n.left.eval(ctx)
+	for _, item := range n.list.items {
+		if item.value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRuleExpressions(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/v1/items?debug=1", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	resp := &http.Response{StatusCode: 418, Header: http.Header{"X-Cache": []string{"MISS"}}}
+	ctx := &exprContext{req: req, ip: "10.1.2.3", resp: resp, size: 2048}
+
+	matches := map[string]bool{
+		`status == 418 && method == "POST" && path startsWith "/api/" && !(header("User-Agent") contains "our-sdk")`: true,
+		`status in [401, 403] || size > 1024`:                     true,
+		`lower(header("user-agent")) matches "^curl/"`:            true,
+		`param("debug") == "1" && respHeader("X-Cache") != "HIT"`: true,
+		`ip startsWith "10." && !(method in ["GET", "HEAD"])`:     true,
+		`path endsWith ".php" || status < 400`:                    false,
+	}
+	for when, want := range matches {
+		rule, err := CompileRule(RuleConfig{Name: "test", When: when})
+		if err != nil {
+			t.Errorf("%s: %v", when, err)
+			continue
+		}
+		if got := rule.Matches(ctx); got != want {
+			t.Errorf("%s: expected %v, got %v", when, want, got)
+		}
+	}
+
+	if rule, _ := CompileRule(RuleConfig{Name: "pre", When: `header("User-Agent") == ""`}); rule.PostResponse {
+		t.Errorf("A request-only rule should run before next")
+	}
+
+	invalid := map[string]string{
+		`status == "418"`:        "can't compare number == string",
+		`path matches "("`:       "invalid regular expression",
+		`method == "GET" &&`:     "column 19",
+		`useragent == "x"`:       "unknown field useragent",
+		`path contains 3`:        "contains needs strings",
+		`status`:                 "must be true or false",
+		`header("X") == "a" "b"`: "unexpected \"b\"",
+	}
+	for when, want := range invalid {
+		if _, err := CompileRule(RuleConfig{Name: "bad", When: when}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", when, want, err)
+		}
+	}
+}
+
+func TestRulesAsTriggers(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.TriggerOnStatusCodes = []int{}
+	config.Rules = []RuleConfig{
+		{Name: "no-ua", When: `header("User-Agent") == ""`, Weight: 2},
+		{Name: "post-teapot", When: `status == 418 && method == "POST"`},
+	}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "10.0.0.1", "", "User-Agent", "").Code; code != 418 {
+		t.Errorf("Expected the pre-request rule (weight 2) to ban, got %d", code)
+	}
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "10.0.0.2", "", "User-Agent", "ok")
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "10.0.0.2", "", "User-Agent", "ok").Code; code != 200 {
+		t.Errorf("A GET 418 doesn't match any rule, got %d", code)
+	}
+	ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/418-please", "10.0.0.3", "", "User-Agent", "ok")
+	ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/418-please", "10.0.0.3", "", "User-Agent", "ok")
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "10.0.0.3", "", "User-Agent", "ok").Code; code != 418 {
+		t.Errorf("Expected two POST 418s to ban, got %d", code)
+	}
+}
@@ -0,0 +1,72 @@
+package teapot_hacker_isolation
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fingerprinter builds a client key from how the request looks rather than where it came from,
+// so scanners rotating IPs keep accumulating violations on the same key.
+// net/http doesn't keep header order or casing, so the set of header names is used instead.
+type Fingerprinter struct {
+	headers      []string
+	tlsHeader    string
+	minInstances int
+}
+
+// used when fingerprintMinInstances isn't set, a fingerprint is shared by everyone on the same browser version
+const defaultFingerprintMinInstances = 50
+
+// NewFingerprinter returns nil unless fingerprint is enabled. It needs fingerprintTlsHeader: headers alone are easy
+// to copy, and a scanner sending a popular browser's headers would get that browser's real users jailed.
+func NewFingerprinter(config *Config) (*Fingerprinter, error) {
+	if !config.Fingerprint {
+		return nil, nil
+	}
+	if config.FingerprintTlsHeader == "" {
+		return nil, fmt.Errorf("fingerprint requires fingerprintTlsHeader, a JA3/JA4 hash injected by the proxy in front")
+	}
+	f := &Fingerprinter{
+		headers:      config.FingerprintHeaders,
+		tlsHeader:    config.FingerprintTlsHeader,
+		minInstances: config.FingerprintMinInstances,
+	}
+	if f.minInstances <= 0 {
+		f.minInstances = defaultFingerprintMinInstances
+	}
+	return f, nil
+}
+
+// Key returns "fp=<hash>" over the HTTP version, the header names present, the configured header values,
+// the negotiated TLS version and cipher, and the JA3/JA4 header if the proxy in front injects one.
+func (f *Fingerprinter) Key(req *http.Request) string {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	parts := []string{req.Proto, strings.Join(names, ",")}
+	for _, h := range f.headers {
+		parts = append(parts, strings.ToLower(h)+"="+req.Header.Get(h))
+	}
+	if req.TLS != nil {
+		parts = append(parts, "tls="+strconv.Itoa(int(req.TLS.Version))+"/"+strconv.Itoa(int(req.TLS.CipherSuite))+"/"+req.TLS.NegotiatedProtocol)
+	}
+	if f.tlsHeader != "" {
+		parts = append(parts, "ja="+req.Header.Get(f.tlsHeader))
+	}
+	return "fp=" + hashIdentityValue(strings.Join(parts, "\n"))
+}
+
+// IsBanned applies fingerprintMinInstances instead of the policy's minInstances and reasonThresholds,
+// since plenty of legitimate clients share the same browser fingerprint.
+func (f *Fingerprinter) IsBanned(found StorageItem) bool {
+	return found.count >= f.minInstances
+}
+
+func isFingerprintKey(identity string) bool {
+	return strings.HasPrefix(identity, "fp=")
+}
@@ -0,0 +1,78 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFingerprintFollowsRotatingIPs(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.Fingerprint = true
+	config.FingerprintTlsHeader = "X-JA3-Hash"
+	config.FingerprintMinInstances = 3
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(target string, ip string, ja3 string) int {
+		return ServeTestRequest(newPlugin, http.MethodGet, target, ip, "", "User-Agent", "gobuster/3.6", "X-JA3-Hash", ja3).Code
+	}
+
+	// one violation per ip, never enough for an ip ban, but they all land on the same fingerprint
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		serve("http://localhost/418-please", ip, "e7d705a3286e19ea42f587b344ee6865")
+	}
+	if code := serve("http://localhost/innocent", "10.0.0.4", "e7d705a3286e19ea42f587b344ee6865"); code != 418 {
+		t.Errorf("Expected the fingerprint to be jailed, got %d", code)
+	}
+	if code := serve("http://localhost/innocent", "10.0.0.4", "6734f37431670b3ab4292b8f60f29984"); code != 200 {
+		t.Errorf("A different TLS stack from the same ip shouldn't be jailed, got %d", code)
+	}
+
+	// copied headers alone are no proof of anything, so fingerprints need the TLS hash
+	config.FingerprintTlsHeader = ""
+	if _, err := CreateTestPlugin(config, ctx); err == nil || !strings.Contains(err.Error(), "fingerprintTlsHeader") {
+		t.Errorf("Expected fingerprint without fingerprintTlsHeader to be refused, got %v", err)
+	}
+}
+
+func TestFingerprintThresholdDoesNotFallBackToMinInstances(t *testing.T) {
+	config := CreateTestConfig()
+	config.Fingerprint = true
+	config.FingerprintTlsHeader = "X-JA3-Hash"
+	config.FingerprintMinInstances = 0
+	newPlugin, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// minInstances is 2, but two violations from different ips on the same browser mustn't jail everyone using it
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", ip, "", "User-Agent", "Firefox/130.0")
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "10.0.0.3", "", "User-Agent", "Firefox/130.0").Code; code != 200 {
+		t.Errorf("Expected the default fingerprint threshold to be %d, got %d", defaultFingerprintMinInstances, code)
+	}
+}
+
+func TestExpiredFingerprintsAreSwept(t *testing.T) {
+	memory := NewMemoryStorage()
+	expired := 0
+	memory.OnExpire = func(key string, item StorageItem) { expired++ }
+
+	// every header permutation is a new fingerprint key, none of them is ever read again
+	for i := 0; i < 3000; i++ {
+		memory.IncrIpViolations("fp="+strconv.Itoa(i), -time.Minute, Violation{Reason: "status:418"})
+	}
+	if len(memory.cache) > memory.cacheSweepAt || expired < 2000 {
+		t.Errorf("Expected expired keys to be swept, %d cached and %d expired", len(memory.cache), expired)
+	}
+	if found, _ := memory.IncrIpViolations("fp=live", time.Minute, Violation{Reason: "status:418"}); found.count != 1 {
+		t.Errorf("Expected live keys to be kept, got %d", found.count)
+	}
+}
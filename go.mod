@@ -2,3 +2,4 @@ module github.com/cdwiegand/teapot-hacker-isolation
 
 go 1.23
 
+require github.com/go-redis/redis/v7 v7.4.1
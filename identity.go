@@ -0,0 +1,144 @@
+package teapot_hacker_isolation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// identityPart is one piece of the violation key: ip, ipprefix, host, useragent, jwt, header:<name> or cookie:<name>
+type identityPart struct {
+	kind string
+	name string
+}
+
+// IdentityBuilder turns a request into the key violations are counted (and bans enforced) against.
+type IdentityBuilder struct {
+	parts    []identityPart
+	v4Prefix int
+	v6Prefix int
+	jwt      *JwtVerifier
+}
+
+func NewIdentityBuilder(config *Config) (*IdentityBuilder, error) {
+	b := &IdentityBuilder{v4Prefix: config.IdentityIPv4Prefix, v6Prefix: config.IdentityIPv6Prefix}
+	if b.v4Prefix <= 0 || b.v4Prefix > 32 {
+		b.v4Prefix = 24
+	}
+	if b.v6Prefix <= 0 || b.v6Prefix > 128 {
+		b.v6Prefix = 64
+	}
+	parts := config.IdentityParts
+	if len(parts) == 0 {
+		parts = []string{"ip"}
+	}
+	for _, p := range parts {
+		kind, name, _ := strings.Cut(p, ":")
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		name = strings.TrimSpace(name)
+		switch kind {
+		case "ip", "ipprefix", "host", "useragent", "jwt":
+			if name != "" {
+				return nil, fmt.Errorf("identity part %s takes no name", p)
+			}
+			if kind == "jwt" && b.jwt == nil {
+				verifier, err := NewJwtVerifier(config)
+				if err != nil {
+					return nil, err
+				}
+				b.jwt = verifier
+			}
+		case "header", "cookie":
+			if name == "" {
+				return nil, fmt.Errorf("identity part %s needs a name, like %s:X-Api-Key", p, kind)
+			}
+		default:
+			return nil, fmt.Errorf("identity part %s unknown", p)
+		}
+		b.parts = append(b.parts, identityPart{kind: kind, name: name})
+	}
+	return b, nil
+}
+
+// IsIpOnly is true for the default configuration, where the key is just the client IP.
+func (b *IdentityBuilder) IsIpOnly() bool {
+	return len(b.parts) == 1 && b.parts[0].kind == "ip"
+}
+
+// Key builds the identity, e.g. "ip=1.2.3.4#header:X-Api-Key=5e884898da280471".
+// Header, cookie and user agent values are hashed so credentials never end up in storage or logs.
+func (b *IdentityBuilder) Key(req *http.Request, ip string) string {
+	if b.IsIpOnly() {
+		return ip
+	}
+	values := make([]string, 0, len(b.parts))
+	for _, part := range b.parts {
+		var v string
+		switch part.kind {
+		case "ip":
+			v = "ip=" + ip
+		case "ipprefix":
+			v = "ipprefix=" + b.ipPrefix(ip)
+		case "host":
+			host, _, err := net.SplitHostPort(req.Host)
+			if err != nil {
+				host = req.Host
+			}
+			v = "host=" + capIdentityValue(strings.ToLower(host))
+		case "jwt":
+			// no (valid) token: fall back to the ip, so anonymous abuse is still jailed
+			if subject, ok := b.jwt.Subject(req); ok {
+				// escaped, subjects like "auth0|123" would otherwise break the "policy|identity" storage keys
+				v = "jwt=" + capIdentityValue(url.PathEscape(subject))
+			} else {
+				v = "ip=" + ip
+			}
+		case "useragent":
+			v = "useragent=" + hashIdentityValue(req.UserAgent())
+		case "header":
+			v = "header:" + part.name + "=" + hashIdentityValue(req.Header.Get(part.name))
+		case "cookie":
+			cookieValue := ""
+			if cookie, err := req.Cookie(part.name); err == nil {
+				cookieValue = cookie.Value
+			}
+			v = "cookie:" + part.name + "=" + hashIdentityValue(cookieValue)
+		}
+		values = append(values, v)
+	}
+	return strings.Join(values, "#")
+}
+
+func (b *IdentityBuilder) ipPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(b.v4Prefix, 32)), Mask: net.CIDRMask(b.v4Prefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(b.v6Prefix, 128)), Mask: net.CIDRMask(b.v6Prefix, 128)}).String()
+}
+
+// longer host names and JWT subjects are hashed, so a client can't fill storage with huge keys
+const maxIdentityValueLength = 128
+
+func capIdentityValue(v string) string {
+	if len(v) <= maxIdentityValueLength {
+		return v
+	}
+	return "~" + hashIdentityValue(v)
+}
+
+// hashIdentityValue returns "-" for missing values, so "no API key" is its own bucket
+func hashIdentityValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:8])
+}
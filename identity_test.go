@@ -0,0 +1,47 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIdentityKeys(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.IdentityParts = []string{"ip", "header:X-Api-Key"}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < config.MinInstances; i++ {
+		ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "", "X-Api-Key", "noisy")
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "0.1.2.3", "", "X-Api-Key", "noisy").Code; code != 418 {
+		t.Errorf("Expected the noisy key to be jailed, got %d", code)
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "0.1.2.3", "", "X-Api-Key", "quiet").Code; code != 200 {
+		t.Errorf("Another key behind the same IP shouldn't be jailed, got %d", code)
+	}
+
+	builder, err := NewIdentityBuilder(&Config{IdentityParts: []string{"ipprefix"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	if key := builder.Key(req, "10.1.2.3"); key != "ipprefix=10.1.2.0/24" {
+		t.Errorf("Unexpected ipv4 prefix key %s", key)
+	}
+	if key := builder.Key(req, "2001:db8:1:2:3:4:5:6"); key != "ipprefix=2001:db8:1:2::/64" {
+		t.Errorf("Unexpected ipv6 prefix key %s", key)
+	}
+	builder, _ = NewIdentityBuilder(&Config{IdentityParts: []string{"host"}})
+	req.Host = strings.Repeat("a", 10000) + ".example.com"
+	if key := builder.Key(req, "10.1.2.3"); len(key) > 32 || !strings.HasPrefix(key, "host=~") {
+		t.Errorf("Expected a long host to be hashed, got %d bytes", len(key))
+	}
+	if _, err := NewIdentityBuilder(&Config{IdentityParts: []string{"header"}}); err == nil {
+		t.Errorf("Expected an error for a header part without a name")
+	}
+}
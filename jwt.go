@@ -0,0 +1,311 @@
+package teapot_hacker_isolation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// allowed clock skew for exp / nbf
+const jwtLeeway = 30 * time.Second
+
+type jwtKey struct {
+	kid string
+	key interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// JwtVerifier pulls the configured claim out of a verified bearer token (or cookie), for per-user identities.
+type JwtVerifier struct {
+	claim      string
+	cookieName string
+	keys       []jwtKey
+}
+
+func NewJwtVerifier(config *Config) (*JwtVerifier, error) {
+	v := &JwtVerifier{claim: config.JwtClaim, cookieName: config.JwtCookieName}
+	if v.claim == "" {
+		v.claim = "sub"
+	}
+	if config.JwtHmacSecret != "" {
+		v.keys = append(v.keys, jwtKey{key: []byte(config.JwtHmacSecret)})
+	}
+	if config.JwtPublicKeyFile != "" {
+		key, err := loadPemPublicKey(config.JwtPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, jwtKey{key: key})
+	}
+	if config.JwtJwksFile != "" {
+		keys, err := loadJwks(config.JwtJwksFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("the jwt identity part needs jwtHmacSecret, jwtPublicKeyFile or jwtJwksFile")
+	}
+	return v, nil
+}
+
+// Subject returns the claim from a valid token, ok is false if there's no token or it doesn't verify.
+func (v *JwtVerifier) Subject(req *http.Request) (string, bool) {
+	token := ""
+	if auth := req.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	} else if v.cookieName != "" {
+		if cookie, err := req.Cookie(v.cookieName); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return "", false
+	}
+	claims, err := v.Verify(token)
+	if err != nil {
+		return "", false
+	}
+	switch value := claims[v.claim].(type) {
+	case string:
+		return value, value != ""
+	case json.Number:
+		return value.String(), true
+	}
+	return "", false
+}
+
+// Verify checks the signature and exp / nbf and returns the claims.
+func (v *JwtVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range v.keys {
+		if k.kid != "" && header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if verifyJwtSignature(header.Alg, k.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	claims := map[string]interface{}{}
+	if err := decodeJwtSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if seconds, err := exp.Int64(); err != nil || now.After(time.Unix(seconds, 0).Add(jwtLeeway)) {
+			return nil, fmt.Errorf("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if seconds, err := nbf.Int64(); err != nil || now.Add(jwtLeeway).Before(time.Unix(seconds, 0)) {
+			return nil, fmt.Errorf("token not valid yet")
+		}
+	}
+	return claims, nil
+}
+
+func decodeJwtSegment(segment string, into interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	return decoder.Decode(into)
+}
+
+// verifyJwtSignature only accepts an algorithm matching the key type, so an RSA public key can't be abused as an HMAC secret.
+func verifyJwtSignature(alg string, key interface{}, signed []byte, signature []byte) bool {
+	if len(alg) != 5 {
+		return false // also rejects "none"
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	switch k := key.(type) {
+	case []byte:
+		if !strings.HasPrefix(alg, "HS") {
+			return false
+		}
+		mac := hmac.New(sha256.New, k)
+		switch hash {
+		case crypto.SHA384:
+			mac = hmac.New(sha512.New384, k)
+		case crypto.SHA512:
+			mac = hmac.New(sha512.New, k)
+		}
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		digest := jwtDigest(hash, signed)
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, jwtDigest(hash, signed), r, s)
+	}
+	return false
+}
+
+func jwtDigest(hash crypto.Hash, signed []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(signed)
+		return sum[:]
+	}
+	sum := sha256.Sum256(signed)
+	return sum[:]
+}
+
+// loadPemPublicKey accepts a PKIX "PUBLIC KEY", a PKCS1 "RSA PUBLIC KEY" or a certificate
+func loadPemPublicKey(path string) (interface{}, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s doesn't contain a PEM block", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: only RSA and ECDSA public keys are supported", path)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJwks reads the RSA and EC signing keys from a JWKS file, other key types are skipped
+func loadJwks(path string) ([]jwtKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	keys := []jwtKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("%s: invalid RSA key %s", path, k.Kid)
+			}
+			keys = append(keys, jwtKey{kid: k.Kid, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}})
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("%s: unsupported curve %s", path, k.Crv)
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("%s: invalid EC key %s", path, k.Kid)
+			}
+			keys = append(keys, jwtKey{kid: k.Kid, key: &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no usable signing keys", path)
+	}
+	return keys, nil
+}
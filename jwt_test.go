@@ -0,0 +1,145 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signTestJwt(alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestJwtIdentity(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.IdentityParts = []string{"jwt"}
+	config.JwtHmacSecret = "s3cret"
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256 := func(sub string, secret string) string {
+		return signTestJwt("HS256", map[string]interface{}{"sub": sub, "exp": time.Now().Add(time.Hour).Unix()}, func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(signed)
+			return mac.Sum(nil)
+		})
+	}
+	serve := func(target string, token string) int {
+		return ServeTestRequest(newPlugin, http.MethodGet, target, "0.1.2.3", "", "Authorization", "Bearer "+token).Code
+	}
+
+	for i := 0; i < config.MinInstances; i++ {
+		serve("http://localhost/418-please", hs256("mallory", "s3cret"))
+	}
+	if code := serve("http://localhost/innocent", hs256("mallory", "s3cret")); code != 418 {
+		t.Errorf("Expected mallory to be jailed, got %d", code)
+	}
+	if code := serve("http://localhost/innocent", hs256("alice", "s3cret")); code != 200 {
+		t.Errorf("Alice shares mallory's IP but shouldn't be jailed, got %d", code)
+	}
+	// a forged token falls back to the (clean) ip
+	if code := serve("http://localhost/innocent", hs256("mallory", "guessed")); code != 200 {
+		t.Errorf("A forged token should fall back to the ip, got %d", code)
+	}
+	if found, _ := newPlugin.getIpViolations("jwt=mallory"); found.count < config.MinInstances {
+		t.Errorf("Expected at least %d violations stored for jwt=mallory, got %d", config.MinInstances, found.count)
+	}
+
+	// subjects may contain the policy separator
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+hs256("auth0|123", "s3cret"))
+	identity := newPlugin.Identity.Key(req, "0.1.2.3")
+	if identity != "jwt=auth0%7C123" {
+		t.Errorf("Expected the subject to be escaped, got %s", identity)
+	}
+	if policy, id := splitPolicyKey(newPlugin.DefaultPolicy.Key(identity)); policy != "" || id != identity {
+		t.Errorf("Expected the default policy key to split back into %s, got %q %q", identity, policy, id)
+	}
+}
+
+func TestJwtPublicKeys(t *testing.T) {
+	dir := t.TempDir()
+	claims := map[string]interface{}{"client_id": "svc-1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	pemFile := filepath.Join(dir, "ec.pem")
+	os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	es256 := signTestJwt("ES256", claims, func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	})
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "k1",
+		"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}}})
+	jwksFile := filepath.Join(dir, "jwks.json")
+	os.WriteFile(jwksFile, jwks, 0600)
+	rs256 := signTestJwt("RS256", claims, func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		return sig
+	})
+
+	config := CreateConfig()
+	config.JwtClaim = "client_id"
+	config.JwtCookieName = "session"
+	config.JwtPublicKeyFile = pemFile
+	config.JwtJwksFile = jwksFile
+	verifier, err := NewJwtVerifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"ES256": es256, "RS256": rs256} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: token})
+		if subject, ok := verifier.Subject(req); !ok || subject != "svc-1" {
+			t.Errorf("%s: expected svc-1, got %q %v", name, subject, ok)
+		}
+	}
+
+	expired := signTestJwt("ES256", map[string]interface{}{"client_id": "svc-1", "exp": time.Now().Add(-time.Hour).Unix()}, func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	})
+	if _, err := verifier.Verify(expired); err == nil {
+		t.Errorf("Expected an expired token to be rejected")
+	}
+	none := signTestJwt("none", claims, func([]byte) []byte { return nil })
+	if _, err := verifier.Verify(none); err == nil {
+		t.Errorf("Expected alg none to be rejected")
+	}
+}
@@ -1,22 +1,169 @@
 package teapot_hacker_isolation
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// ParseLogLevel accepts debug, info, warn/warning and error (case insensitive), empty means info.
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "", "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	return LogLevelInfo, fmt.Errorf("log level %s unknown", level)
+}
+
+// LogFields are structured key/values attached to a log line (ip, action, reason, count, ...)
+type LogFields map[string]any
+
 type MyTraefikLogger struct {
-	prefix string
+	prefix     string
+	middleware string
+	level      LogLevel
+	json       bool
+	lock       sync.Mutex
+	stdout     io.Writer
+	stderr     io.Writer
 }
 
 func NewMyTraefikLogger(prefix string) *MyTraefikLogger {
 	return &MyTraefikLogger{
 		prefix: prefix,
+		level:  LogLevelInfo,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+}
+
+// NewMyTraefikLoggerFromConfig builds the logger from the logLevel / logFormat / loggingPrefix options.
+func NewMyTraefikLoggerFromConfig(config *Config, middleware string) (*MyTraefikLogger, error) {
+	logger := NewMyTraefikLogger(config.LoggingPrefix)
+	logger.middleware = middleware
+	level, err := ParseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logger.level = level
+	switch strings.ToLower(config.LogFormat) {
+	case "", "text":
+		logger.json = false
+	case "json":
+		logger.json = true
+	default:
+		return nil, fmt.Errorf("log format %s unknown", config.LogFormat)
+	}
+	return logger, nil
+}
+
+func (logger *MyTraefikLogger) Enabled(level LogLevel) bool {
+	return level >= logger.level
+}
+
+// Log writes one line: warnings and errors go to stderr, the rest to stdout (like Traefik's own plugin logs).
+func (logger *MyTraefikLogger) Log(level LogLevel, message string, fields LogFields) {
+	if !logger.Enabled(level) {
+		return
 	}
+	var line string
+	if logger.json {
+		line = logger.formatJson(level, message, fields)
+	} else {
+		line = logger.formatText(level, message, fields)
+	}
+	out := logger.stdout
+	if level >= LogLevelWarn {
+		out = logger.stderr
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	io.WriteString(out, line+"\n")
+}
+
+func (logger *MyTraefikLogger) formatText(level LogLevel, message string, fields LogFields) string {
+	sb := strings.Builder{}
+	sb.WriteString(time.Now().UTC().Format(time.RFC3339))
+	sb.WriteString(" " + level.String() + ": ")
+	sb.WriteString(logger.prefix)
+	sb.WriteString(message)
+	if logger.middleware != "" {
+		sb.WriteString(" middleware=" + quoteIfNeeded(logger.middleware))
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sb.WriteString(" " + k + "=" + quoteIfNeeded(fmt.Sprint(fields[k])))
+	}
+	return sb.String()
+}
+
+func (logger *MyTraefikLogger) formatJson(level LogLevel, message string, fields LogFields) string {
+	entry := make(map[string]any, len(fields)+4)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339)
+	entry["level"] = strings.ToLower(level.String())
+	entry["msg"] = strings.TrimSpace(logger.prefix + message)
+	if logger.middleware != "" {
+		entry["middleware"] = logger.middleware
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return logger.formatText(level, message, fields)
+	}
+	return string(data)
+}
+
+func quoteIfNeeded(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		return fmt.Sprintf("%q", v)
+	}
+	return v
 }
 
 func (logger *MyTraefikLogger) Error(message string) {
-	os.Stderr.WriteString("ERROR: " + message)
+	logger.Log(LogLevelError, message, nil)
 }
 func (logger *MyTraefikLogger) Errore(err error, message string) {
 	logger.Error(fmt.Sprint(err) + ": " + message)
@@ -27,9 +174,12 @@ func (logger *MyTraefikLogger) Errorf(format string, v ...any) {
 func (logger *MyTraefikLogger) Erroref(err error, format string, v ...any) {
 	logger.Error(fmt.Sprint(err) + ": " + fmt.Sprintf(format, v...))
 }
+func (logger *MyTraefikLogger) Errorw(message string, fields LogFields) {
+	logger.Log(LogLevelError, message, fields)
+}
 
 func (logger *MyTraefikLogger) Warn(message string) {
-	os.Stderr.WriteString("WARN: " + message)
+	logger.Log(LogLevelWarn, message, nil)
 }
 func (logger *MyTraefikLogger) Warne(err error, message string) {
 	logger.Warn(fmt.Sprint(err) + ": " + message)
@@ -40,9 +190,12 @@ func (logger *MyTraefikLogger) Warnf(format string, v ...any) {
 func (logger *MyTraefikLogger) Warnef(err error, format string, v ...any) {
 	logger.Warn(fmt.Sprint(err) + ": " + fmt.Sprintf(format, v...))
 }
+func (logger *MyTraefikLogger) Warnw(message string, fields LogFields) {
+	logger.Log(LogLevelWarn, message, fields)
+}
 
 func (logger *MyTraefikLogger) Info(message string) {
-	os.Stdout.WriteString("INFO: " + message)
+	logger.Log(LogLevelInfo, message, nil)
 }
 func (logger *MyTraefikLogger) Infoe(err error, message string) {
 	logger.Info(fmt.Sprint(err) + ": " + message)
@@ -53,9 +206,12 @@ func (logger *MyTraefikLogger) Infof(format string, v ...any) {
 func (logger *MyTraefikLogger) Infoef(err error, format string, v ...any) {
 	logger.Info(fmt.Sprint(err) + ": " + fmt.Sprintf(format, v...))
 }
+func (logger *MyTraefikLogger) Infow(message string, fields LogFields) {
+	logger.Log(LogLevelInfo, message, fields)
+}
 
 func (logger *MyTraefikLogger) Debug(message string) {
-	os.Stdout.WriteString("DEBUG: " + message)
+	logger.Log(LogLevelDebug, message, nil)
 }
 func (logger *MyTraefikLogger) Debuge(err error, message string) {
 	logger.Debug(fmt.Sprint(err) + ": " + message)
@@ -66,3 +222,6 @@ func (logger *MyTraefikLogger) Debugf(format string, v ...any) {
 func (logger *MyTraefikLogger) Debugef(err error, format string, v ...any) {
 	logger.Debug(fmt.Sprint(err) + ": " + fmt.Sprintf(format, v...))
 }
+func (logger *MyTraefikLogger) Debugw(message string, fields LogFields) {
+	logger.Log(LogLevelDebug, message, fields)
+}
@@ -0,0 +1,222 @@
+package teapot_hacker_isolation
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default latency buckets (seconds) for storage round trips
+var defaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Metrics is a tiny, dependency-free Prometheus text exposition registry -
+// Traefik runs plugins under Yaegi, so we can't pull in client_golang.
+type Metrics struct {
+	mu         sync.Mutex
+	middleware string
+	counters   map[string]*metricCounter
+	histograms map[string]*metricHistogram
+}
+
+type metricCounter struct {
+	help   string
+	label  string
+	values map[string]uint64
+}
+
+type metricHistogram struct {
+	help    string
+	label   string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewMetrics(middleware string) *Metrics {
+	m := &Metrics{
+		middleware: middleware,
+		counters:   make(map[string]*metricCounter),
+		histograms: make(map[string]*metricHistogram),
+	}
+	m.RegisterCounter("teapot_requests_total", "Requests seen by the middleware.", "")
+	m.RegisterCounter("teapot_violations_total", "Violations counted, by trigger type.", "trigger")
+	m.RegisterCounter("teapot_blocked_requests_total", "Requests answered with a block response.", "")
+	m.RegisterCounter("teapot_bans_total", "Clients that crossed the threshold and were newly jailed.", "")
+	m.RegisterCounter("teapot_unbans_total", "Jailed clients whose ban expired.", "")
+	m.RegisterCounter("teapot_storage_errors_total", "Storage operations that failed, by operation.", "operation")
+	m.RegisterHistogram("teapot_storage_latency_seconds", "Storage operation latency, by operation.", "operation", defaultLatencyBuckets)
+	return m
+}
+
+// RegisterCounter declares a counter with at most one label (empty label means unlabelled).
+func (m *Metrics) RegisterCounter(name string, help string, label string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.counters[name]; !ok {
+		m.counters[name] = &metricCounter{help: help, label: label, values: make(map[string]uint64)}
+	}
+}
+
+// RegisterHistogram declares a histogram with at most one label.
+func (m *Metrics) RegisterHistogram(name string, help string, label string, buckets []float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.histograms[name]; !ok {
+		m.histograms[name] = &metricHistogram{help: help, label: label, buckets: buckets, series: make(map[string]*histogramSeries)}
+	}
+}
+
+// Inc bumps a counter, labelValue is ignored for unlabelled counters. Unknown names are ignored.
+func (m *Metrics) Inc(name string, labelValue string) {
+	m.Add(name, labelValue, 1)
+}
+
+func (m *Metrics) Add(name string, labelValue string, delta uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[name]
+	if !ok {
+		return
+	}
+	if c.label == "" {
+		labelValue = ""
+	}
+	c.values[labelValue] += delta
+}
+
+// Observe records a value (in seconds for latencies) into a histogram.
+func (m *Metrics) Observe(name string, labelValue string, value float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.histograms[name]
+	if !ok {
+		return
+	}
+	if h.label == "" {
+		labelValue = ""
+	}
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, le := range h.buckets {
+		if value <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// ObserveSince is a helper for latency histograms.
+func (m *Metrics) ObserveSince(name string, labelValue string, start time.Time) {
+	m.Observe(name, labelValue, time.Since(start).Seconds())
+}
+
+// Counter returns the current value of a counter, mostly for tests.
+func (m *Metrics) Counter(name string, labelValue string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.counters[name]; ok {
+		return c.values[labelValue]
+	}
+	return 0
+}
+
+// WriteText renders every metric in the Prometheus text exposition format (version 0.0.4).
+func (m *Metrics) WriteText(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counterNames := []string{}
+	for name := range m.counters {
+		counterNames = append(counterNames, name)
+	}
+	for _, name := range sortStrings(counterNames) {
+		c := m.counters[name]
+		fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", name, c.help, name)
+		if len(c.values) == 0 && c.label == "" {
+			fmt.Fprintf(sb, "%s%s 0\n", name, m.labels("", ""))
+			continue
+		}
+		labelValues := []string{}
+		for lv := range c.values {
+			labelValues = append(labelValues, lv)
+		}
+		for _, lv := range sortStrings(labelValues) {
+			fmt.Fprintf(sb, "%s%s %d\n", name, m.labels(c.label, lv), c.values[lv])
+		}
+	}
+
+	histogramNames := []string{}
+	for name := range m.histograms {
+		histogramNames = append(histogramNames, name)
+	}
+	for _, name := range sortStrings(histogramNames) {
+		h := m.histograms[name]
+		fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name)
+		labelValues := []string{}
+		for lv := range h.series {
+			labelValues = append(labelValues, lv)
+		}
+		for _, lv := range sortStrings(labelValues) {
+			s := h.series[lv]
+			for i, le := range h.buckets {
+				fmt.Fprintf(sb, "%s_bucket%s %d\n", name, m.labels(h.label, lv, "le", formatFloat(le)), s.counts[i])
+			}
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", name, m.labels(h.label, lv, "le", "+Inf"), s.count)
+			fmt.Fprintf(sb, "%s_sum%s %s\n", name, m.labels(h.label, lv), formatFloat(s.sum))
+			fmt.Fprintf(sb, "%s_count%s %d\n", name, m.labels(h.label, lv), s.count)
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	sb := strings.Builder{}
+	m.WriteText(&sb)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(sb.String()))
+}
+
+// labels builds {middleware="...",k="v",...}, skipping pairs with an empty key
+func (m *Metrics) labels(pairs ...string) string {
+	parts := []string{fmt.Sprintf("middleware=\"%s\"", escapeLabel(m.middleware))}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == "" {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", pairs[i], escapeLabel(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatFloat(f float64) string {
+	return fmt.Sprintf("%g", f)
+}
+
+func sortStrings(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
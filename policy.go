@@ -0,0 +1,273 @@
+package teapot_hacker_isolation
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PolicyConfig overrides thresholds, triggers and the block response for matching requests.
+// Unset (zero) fields inherit the top-level setting.
+type PolicyConfig struct {
+	Name                    string         `json:"name"`
+	Hosts                   []string       `json:"hosts"`
+	PathPrefixes            []string       `json:"pathPrefixes"`
+	PathRegex               string         `json:"pathRegex"`
+	Methods                 []string       `json:"methods"`
+	MinInstances            int            `json:"minInstances"`
+	ExpirySeconds           int            `json:"expirySeconds"`
+	TriggerOnHeaders        []string       `json:"triggerOnHeaders"`
+	TriggerOnStatusCodes    []int          `json:"triggerOnStatusCodes"`
+	ReturnStatusCodeOnBlock int            `json:"blockedStatusCode"`
+	ReturnBodyOnBlock       string         `json:"blockedBody"`
+	ReturnHeadersOnBlock    []string       `json:"blockedHeaders"`
+	ReasonThresholds        map[string]int `json:"reasonThresholds"`
+	TriggerOnLatencyMs      int            `json:"triggerOnLatencyMs"`
+	TriggerOnResponseBytes  int            `json:"triggerOnResponseBytes"`
+}
+
+// Policy is a compiled PolicyConfig with every setting resolved.
+// The default policy (no name) is built from the top-level config and keeps the plain ip keys.
+type Policy struct {
+	Name                    string
+	hosts                   []string
+	pathPrefixes            []string
+	pathRegex               *regexp.Regexp
+	methods                 []string
+	MinInstances            int
+	ExpirySeconds           int
+	TriggerOnHeaders        []string
+	TriggerOnStatusCodes    []int
+	ReturnStatusCodeOnBlock int
+	ReturnBodyOnBlock       string
+	ReturnHeadersOnBlock    []string
+	ReasonThresholds        map[string]int
+	TriggerOnLatencyMs      int
+	TriggerOnResponseBytes  int
+}
+
+func NewDefaultPolicy(config *Config) *Policy {
+	return &Policy{
+		MinInstances:            config.MinInstances,
+		ExpirySeconds:           config.ExpirySeconds,
+		TriggerOnHeaders:        config.TriggerOnHeaders,
+		TriggerOnStatusCodes:    config.TriggerOnStatusCodes,
+		ReturnStatusCodeOnBlock: config.ReturnStatusCodeOnBlock,
+		ReturnBodyOnBlock:       config.ReturnBodyOnBlock,
+		ReturnHeadersOnBlock:    config.ReturnHeadersOnBlock,
+		ReasonThresholds:        config.ReasonThresholds,
+		TriggerOnLatencyMs:      config.TriggerOnLatencyMs,
+		TriggerOnResponseBytes:  config.TriggerOnResponseBytes,
+	}
+}
+
+func NewPolicy(pc PolicyConfig, defaults *Policy) (*Policy, error) {
+	if pc.Name == "" {
+		return nil, fmt.Errorf("every policy needs a name")
+	}
+	if strings.Contains(pc.Name, "|") {
+		return nil, fmt.Errorf("policy name %s can't contain |", pc.Name)
+	}
+	if pc.Name == "auth" || pc.Name == "auth-user" {
+		return nil, fmt.Errorf("policy name %s is reserved for authPaths", pc.Name)
+	}
+	p := *defaults
+	p.Name = pc.Name
+	p.hosts = pc.Hosts
+	p.pathPrefixes = pc.PathPrefixes
+	p.methods = pc.Methods
+	if pc.PathRegex != "" {
+		re, err := regexp.Compile(pc.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", pc.Name, err)
+		}
+		p.pathRegex = re
+	}
+	if pc.MinInstances > 0 {
+		p.MinInstances = pc.MinInstances
+	}
+	if pc.ExpirySeconds > 0 {
+		p.ExpirySeconds = pc.ExpirySeconds
+	}
+	if pc.TriggerOnHeaders != nil {
+		p.TriggerOnHeaders = pc.TriggerOnHeaders
+	}
+	if pc.TriggerOnStatusCodes != nil {
+		p.TriggerOnStatusCodes = pc.TriggerOnStatusCodes
+	}
+	if pc.ReturnStatusCodeOnBlock > 0 {
+		p.ReturnStatusCodeOnBlock = pc.ReturnStatusCodeOnBlock
+	}
+	if pc.ReturnBodyOnBlock != "" {
+		p.ReturnBodyOnBlock = pc.ReturnBodyOnBlock
+	}
+	if pc.ReturnHeadersOnBlock != nil {
+		p.ReturnHeadersOnBlock = pc.ReturnHeadersOnBlock
+	}
+	if pc.ReasonThresholds != nil {
+		p.ReasonThresholds = pc.ReasonThresholds
+	}
+	if pc.TriggerOnLatencyMs > 0 {
+		p.TriggerOnLatencyMs = pc.TriggerOnLatencyMs
+	}
+	if pc.TriggerOnResponseBytes > 0 {
+		p.TriggerOnResponseBytes = pc.TriggerOnResponseBytes
+	}
+	return &p, nil
+}
+
+// Matches is true when every configured criterion matches, a policy without criteria matches everything (a global policy).
+func (p *Policy) Matches(req *http.Request) bool {
+	if len(p.hosts) > 0 {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if !containsFold(p.hosts, host) {
+			return false
+		}
+	}
+	if len(p.methods) > 0 && !containsFold(p.methods, req.Method) {
+		return false
+	}
+	if len(p.pathPrefixes) > 0 {
+		matched := false
+		for _, prefix := range p.pathPrefixes {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if p.pathRegex != nil && !p.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	return true
+}
+
+// Key namespaces the storage key per policy, so a ban under one policy doesn't block the others.
+func (p *Policy) Key(ip string) string {
+	if p.Name == "" {
+		return ip
+	}
+	return p.Name + "|" + ip
+}
+
+func (p *Policy) JailTime() time.Duration {
+	return time.Duration(p.ExpirySeconds) * time.Minute
+}
+
+// DetectTrigger returns the reason for the violation ("status:405", "header:X-Hacker-Detected"), or "" if no trigger matched
+func (p *Policy) DetectTrigger(resp *http.Response) string {
+	for _, v := range p.TriggerOnStatusCodes {
+		if resp.StatusCode == v {
+			return "status:" + strconv.Itoa(v)
+		}
+	}
+	// check headers
+	for name := range resp.Header {
+		for _, detect := range p.TriggerOnHeaders {
+			if strings.EqualFold(name, detect) {
+				return "header:" + detect
+			}
+		}
+	}
+	return ""
+}
+
+// DetectCost returns "latency:<threshold>ms" or "size:<threshold>" if the backend took too long or answered too much, or ""
+func (p *Policy) DetectCost(latency time.Duration, size int) string {
+	if p.TriggerOnLatencyMs > 0 && latency >= time.Duration(p.TriggerOnLatencyMs)*time.Millisecond {
+		return "latency:" + strconv.Itoa(p.TriggerOnLatencyMs) + "ms"
+	}
+	if p.TriggerOnResponseBytes > 0 && size >= p.TriggerOnResponseBytes {
+		return "size:" + strconv.Itoa(p.TriggerOnResponseBytes)
+	}
+	return ""
+}
+
+// IsBanned is true once the total count, or the count for any single reason, reaches its threshold.
+// reasonThresholds keys can be a full reason ("status:405") or just its kind ("status").
+func (p *Policy) IsBanned(found StorageItem) bool {
+	if found.count >= p.MinInstances {
+		return true
+	}
+	if len(p.ReasonThresholds) == 0 {
+		return false
+	}
+	kinds := make(map[string]int)
+	for reason, count := range found.reasons {
+		if threshold, ok := p.ReasonThresholds[reason]; ok && threshold > 0 && count >= threshold {
+			return true
+		}
+		kinds[reasonKind(reason)] += count
+	}
+	for kind, count := range kinds {
+		if threshold, ok := p.ReasonThresholds[kind]; ok && threshold > 0 && count >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// reasonKind is the part before the colon: "status:405" -> "status"
+func reasonKind(reason string) string {
+	if i := strings.Index(reason, ":"); i >= 0 {
+		return reason[:i]
+	}
+	return reason
+}
+
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPolicyKey undoes Policy.Key
+func splitPolicyKey(key string) (string, string) {
+	if i := strings.Index(key, "|"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// matchPolicies returns every configured policy matching req, or the default policy if none do.
+func (t *TeapotHackerIsolationPlugin) matchPolicies(req *http.Request) []*Policy {
+	matched := []*Policy{}
+	for _, p := range t.Policies {
+		if p.Matches(req) {
+			matched = append(matched, p)
+		}
+	}
+	if len(matched) == 0 {
+		matched = append(matched, t.DefaultPolicy)
+	}
+	return matched
+}
+
+func (t *TeapotHackerIsolationPlugin) policyByName(name string) *Policy {
+	for _, p := range t.Policies {
+		if p.Name == name {
+			return p
+		}
+	}
+	if t.Auth != nil {
+		for _, p := range []*Policy{t.Auth.ipPolicy, t.Auth.userPolicy} {
+			if p.Name == name {
+				return p
+			}
+		}
+	}
+	return t.DefaultPolicy
+}
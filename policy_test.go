@@ -0,0 +1,88 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestPoliciesHaveSeparateCounters(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.Policies = []PolicyConfig{
+		{Name: "login", PathPrefixes: []string{"/login"}, Methods: []string{"POST"}, MinInstances: 1, ReturnStatusCodeOnBlock: 403},
+		{Name: "api", Hosts: []string{"api.localhost"}, PathRegex: "^/v[0-9]+/", MinInstances: 3},
+	}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a single violation on login bans, with login's own block status
+	if code := ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/login/418", "0.1.2.3", "").Code; code != 403 {
+		t.Fatalf("Expected login policy to ban after 1 violation, got %d", code)
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodPost, "http://localhost/login", "0.1.2.3", "").Code; code != 403 {
+		t.Errorf("Expected login to stay blocked, got %d", code)
+	}
+	// ... but the rest of the site isn't affected
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/static/app.js", "0.1.2.3", "").Code; code != 200 {
+		t.Errorf("Login ban shouldn't block other paths, got %d", code)
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/login", "0.1.2.3", "").Code; code != 200 {
+		t.Errorf("Login policy only matches POST, got %d", code)
+	}
+
+	// api allows 3
+	for i := 0; i < 2; i++ {
+		if code := ServeTestRequest(newPlugin, http.MethodGet, "http://api.localhost/v1/418", "0.1.2.3", "").Code; code != 418 {
+			t.Fatalf("Expected the backend's 418 pass through, got %d", code)
+		}
+	}
+	if found, _ := newPlugin.Storage.GetIpViolations("api|0.1.2.3"); found.count != 2 {
+		t.Errorf("Expected 2 violations under the api policy, got %d", found.count)
+	}
+	if found, _ := newPlugin.Storage.GetIpViolations("0.1.2.3"); found.count != 0 {
+		t.Errorf("Expected no violations under the default policy, got %d", found.count)
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	config := CreateTestConfig()
+	config.Policies = []PolicyConfig{{Name: "broken", PathRegex: "("}}
+	if _, err := CreateTestPlugin(config, context.Background()); err == nil {
+		t.Error("Expected an error for an invalid pathRegex")
+	}
+	config.Policies = []PolicyConfig{{PathPrefixes: []string{"/x"}}}
+	if _, err := CreateTestPlugin(config, context.Background()); err == nil {
+		t.Error("Expected an error for a policy without a name")
+	}
+}
+
+func TestLatencyAndSizeTriggers(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.TriggerOnLatencyMs = 20
+	config.Policies = []PolicyConfig{{Name: "exports", PathPrefixes: []string{"/export"}, TriggerOnResponseBytes: 1024}}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/slow", "10.0.0.1", "").Code; code != 200 {
+		t.Errorf("One slow response shouldn't ban, got %d", code)
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/slow", "10.0.0.1", "").Code; code != 418 {
+		t.Errorf("Expected the second slow response to ban, got %d", code)
+	}
+	if found, _ := newPlugin.getIpViolations("10.0.0.1"); found.reasons["latency:20ms"] != 2 {
+		t.Errorf("Expected 2 latency violations, got %v", found.reasons)
+	}
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/fast", "10.0.0.2", "").Code; code != 200 {
+		t.Errorf("A fast response shouldn't count, got %d", code)
+	}
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/export", "10.0.0.3", "")
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/export", "10.0.0.3", "").Code; code != 418 {
+		t.Errorf("Expected the second large export to ban, got %d", code)
+	}
+}
@@ -0,0 +1,32 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRateFloodIsAViolation(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.RateLimitRequests = 3
+	config.RateLimitPeriodSeconds = 60
+	config.RateLimitWeight = 2
+	config.ReturnCurrentReasonsHeader = "X-Reasons-Teapot"
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "0.1.2.3", ""); recorder.Code != 200 || recorder.Header().Get("X-Reasons-Teapot") != "" {
+			t.Fatalf("Request %d is within the limit, got %d %q", i, recorder.Code, recorder.Header().Get("X-Reasons-Teapot"))
+		}
+	}
+	// weight 2 reaches minInstances (2) in one go
+	if recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/innocent", "0.1.2.3", ""); recorder.Code != 418 {
+		t.Errorf("Expected the flood to be jailed, got %d", recorder.Code)
+	}
+	if found, _ := newPlugin.getIpViolations("0.1.2.3"); found.reasons["rate"] != 2 {
+		t.Errorf("Expected a rate violation of weight 2, got %v", found.reasons)
+	}
+}
@@ -0,0 +1,261 @@
+package teapot_hacker_isolation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	securityLogVendor  = "cdwiegand"
+	securityLogProduct = "teapot-hacker-isolation"
+	securityLogVersion = "1.0"
+)
+
+// SecurityEvent is one line in the security event log, independent of the operational log.
+type SecurityEvent struct {
+	Time       time.Time
+	Type       string // violation or ban
+	IP         string
+	Reason     string
+	Count      int
+	Expires    int64
+	Method     string
+	Host       string
+	Path       string
+	Middleware string
+}
+
+// SecurityLog writes security events (fail2ban, CEF, LEEF or JSON) to stdout or a size-rotated file.
+type SecurityLog struct {
+	path       string
+	format     string
+	maxBytes   int64
+	maxBackups int
+	lock       sync.Mutex
+	out        io.Writer
+	file       *os.File
+	size       int64
+	// the last rotation moved the file away but couldn't open a new one, the next one only retries the open
+	reopen bool
+	// OnRotateError (optional) is told when rotating fails, the event is still written to the current file
+	OnRotateError func(err error)
+}
+
+func NewSecurityLog(config *Config) (*SecurityLog, error) {
+	format := strings.ToLower(config.SecurityLogFormat)
+	switch format {
+	case "":
+		format = "fail2ban"
+	case "fail2ban", "cef", "leef", "json":
+	default:
+		return nil, fmt.Errorf("security log format %s unknown", config.SecurityLogFormat)
+	}
+	s := &SecurityLog{
+		path:       config.SecurityLogPath,
+		format:     format,
+		maxBytes:   int64(config.SecurityLogMaxSizeMB) * 1024 * 1024,
+		maxBackups: config.SecurityLogMaxBackups,
+	}
+	switch strings.ToLower(s.path) {
+	case "stdout":
+		s.out = os.Stdout
+	case "stderr":
+		s.out = os.Stderr
+	default:
+		if err := s.open(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *SecurityLog) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.out = file
+	s.size = info.Size()
+	return nil
+}
+
+// rotate shifts path -> path.1 -> path.2 ... dropping anything past maxBackups, must be called with lock held
+func (s *SecurityLog) rotate() error {
+	old := s.file
+	if !s.reopen && s.maxBackups <= 0 {
+		os.Remove(s.path)
+	} else if !s.reopen {
+		os.Remove(s.path + "." + strconv.Itoa(s.maxBackups))
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+		}
+		os.Rename(s.path, s.path+".1")
+	}
+	if err := s.open(); err != nil {
+		// keep writing to the old (rotated) file rather than a closed one, the next write tries again
+		s.reopen = true
+		return err
+	}
+	s.reopen = false
+	return old.Close()
+}
+
+// Write is safe to call on a nil SecurityLog (security logging disabled).
+func (s *SecurityLog) Write(event SecurityEvent) error {
+	if s == nil {
+		return nil
+	}
+	line := s.Format(event) + "\n"
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file != nil && s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil && s.OnRotateError != nil {
+			s.OnRotateError(err)
+		}
+	}
+	n, err := io.WriteString(s.out, line)
+	s.size += int64(n)
+	return err
+}
+
+// Close is safe to call more than once, later writes are discarded.
+func (s *SecurityLog) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file, s.out = nil, io.Discard
+	return err
+}
+
+func (s *SecurityLog) Format(event SecurityEvent) string {
+	switch s.format {
+	case "cef":
+		return formatCef(event)
+	case "leef":
+		return formatLeef(event)
+	case "json":
+		return formatSecurityJson(event)
+	default:
+		return formatFail2ban(event)
+	}
+}
+
+// fail2ban-friendly, match with: failregex = ^.* teapot-hacker-isolation\[.*\]: (VIOLATION|BAN) from <HOST> .*$
+func formatFail2ban(event SecurityEvent) string {
+	return fmt.Sprintf("%s %s[%s]: %s from %s reason=%s count=%d method=%s path=%q",
+		event.Time.UTC().Format("2006-01-02 15:04:05"), securityLogProduct, event.Middleware,
+		strings.ToUpper(event.Type), event.IP, event.Reason, event.Count, event.Method, event.Path)
+}
+
+func securityEventSeverity(event SecurityEvent) int {
+	if event.Type == "ban" {
+		return 8
+	}
+	return 5
+}
+
+func securityEventName(event SecurityEvent) string {
+	if event.Type == "ban" {
+		return "Client jailed"
+	}
+	return "Hacker violation detected"
+}
+
+// ArcSight Common Event Format
+func formatCef(event SecurityEvent) string {
+	ext := []string{
+		"rt=" + strconv.FormatInt(event.Time.UnixMilli(), 10),
+		"src=" + cefEscapeValue(event.IP),
+		"requestMethod=" + cefEscapeValue(event.Method),
+		"request=" + cefEscapeValue(event.Path),
+		"dhost=" + cefEscapeValue(event.Host),
+		"cs1Label=reason",
+		"cs1=" + cefEscapeValue(event.Reason),
+		"cs2Label=middleware",
+		"cs2=" + cefEscapeValue(event.Middleware),
+		"cnt=" + strconv.Itoa(event.Count),
+	}
+	if event.Expires > 0 {
+		ext = append(ext, "end="+strconv.FormatInt(event.Expires*1000, 10))
+	}
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		cefEscapeHeader(securityLogVendor), cefEscapeHeader(securityLogProduct), cefEscapeHeader(securityLogVersion),
+		cefEscapeHeader(event.Type), cefEscapeHeader(securityEventName(event)), securityEventSeverity(event),
+		strings.Join(ext, " "))
+}
+
+func cefEscapeHeader(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return strings.ReplaceAll(v, "|", `\|`)
+}
+
+func cefEscapeValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "=", `\=`)
+	v = strings.ReplaceAll(v, "\r", `\r`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+// QRadar Log Event Extended Format 1.0 (tab delimited attributes)
+func formatLeef(event SecurityEvent) string {
+	attrs := []string{
+		"devTime=" + event.Time.UTC().Format("Jan 02 2006 15:04:05"),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss",
+		"src=" + leefEscapeValue(event.IP),
+		"sev=" + strconv.Itoa(securityEventSeverity(event)),
+		"cat=" + leefEscapeValue(event.Reason),
+		"method=" + leefEscapeValue(event.Method),
+		"url=" + leefEscapeValue(event.Path),
+		"dstHost=" + leefEscapeValue(event.Host),
+		"count=" + strconv.Itoa(event.Count),
+		"middleware=" + leefEscapeValue(event.Middleware),
+	}
+	if event.Expires > 0 {
+		attrs = append(attrs, "expires="+strconv.FormatInt(event.Expires, 10))
+	}
+	return fmt.Sprintf("LEEF:1.0|%s|%s|%s|%s|%s",
+		securityLogVendor, securityLogProduct, securityLogVersion, event.Type, strings.Join(attrs, "\t"))
+}
+
+func leefEscapeValue(v string) string {
+	v = strings.ReplaceAll(v, "\t", " ")
+	v = strings.ReplaceAll(v, "\r", " ")
+	return strings.ReplaceAll(v, "\n", " ")
+}
+
+func formatSecurityJson(event SecurityEvent) string {
+	entry := map[string]any{
+		"time":       event.Time.UTC().Format(time.RFC3339),
+		"event":      event.Type,
+		"ip":         event.IP,
+		"reason":     event.Reason,
+		"count":      event.Count,
+		"method":     event.Method,
+		"host":       event.Host,
+		"path":       event.Path,
+		"middleware": event.Middleware,
+	}
+	if event.Expires > 0 {
+		entry["expires"] = event.Expires
+	}
+	data, _ := json.Marshal(entry)
+	return string(data)
+}
@@ -0,0 +1,109 @@
+package teapot_hacker_isolation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestSecurityEvent() SecurityEvent {
+	return SecurityEvent{
+		Time:       time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		Type:       "ban",
+		IP:         "0.1.2.3",
+		Reason:     "status",
+		Count:      2,
+		Expires:    1714567000,
+		Method:     "GET",
+		Host:       "localhost",
+		Path:       "/wp-login.php",
+		Middleware: "testing",
+	}
+}
+
+func TestSecurityLogFormats(t *testing.T) {
+	event := createTestSecurityEvent()
+	expected := map[string]string{
+		"fail2ban": `2024-05-01 12:30:00 teapot-hacker-isolation[testing]: BAN from 0.1.2.3 reason=status count=2 method=GET path="/wp-login.php"`,
+		"cef":      "CEF:0|cdwiegand|teapot-hacker-isolation|1.0|ban|Client jailed|8|rt=1714566600000 src=0.1.2.3 ",
+		"leef":     "LEEF:1.0|cdwiegand|teapot-hacker-isolation|1.0|ban|devTime=May 01 2024 12:30:00\t",
+		"json":     `"event":"ban"`,
+	}
+	for format, want := range expected {
+		s := &SecurityLog{format: format}
+		got := s.Format(event)
+		if !strings.Contains(got, want) {
+			t.Errorf("%s: expected %q in %q", format, want, got)
+		}
+	}
+}
+
+func TestSecurityLogRotation(t *testing.T) {
+	config := CreateTestConfig()
+	config.SecurityLogPath = filepath.Join(t.TempDir(), "security.log")
+	config.SecurityLogMaxBackups = 2
+	s, err := NewSecurityLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.maxBytes = 300 // a couple of lines per file
+
+	for i := 0; i < 10; i++ {
+		if err := s.Write(createTestSecurityEvent()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{config.SecurityLogPath, config.SecurityLogPath + ".1", config.SecurityLogPath + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %s", name, err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s is %d bytes, should have been rotated", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(config.SecurityLogPath + ".3"); err == nil {
+		t.Error("Only 2 backups should be kept")
+	}
+}
+
+func TestSecurityLogSurvivesFailedRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	os.Mkdir(dir, 0o750)
+	config := CreateTestConfig()
+	config.SecurityLogPath = filepath.Join(dir, "security.log")
+	config.SecurityLogMaxBackups = 0
+	s, err := NewSecurityLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.maxBytes = 100 // rotate on every write
+	rotateErrors := 0
+	s.OnRotateError = func(err error) { rotateErrors++ }
+
+	s.Write(createTestSecurityEvent())
+	os.RemoveAll(dir)
+	size := s.size
+	if err := s.Write(createTestSecurityEvent()); err != nil || rotateErrors != 1 {
+		t.Errorf("Expected the failed rotation to be reported on its own, got %v and %d reports", err, rotateErrors)
+	}
+	if s.size <= size {
+		t.Error("Expected the event to be written to the current file anyway")
+	}
+	os.Mkdir(dir, 0o750)
+	if err := s.Write(createTestSecurityEvent()); err != nil {
+		t.Errorf("Expected the log to recover once it can be reopened, got %s", err)
+	}
+	if info, err := os.Stat(config.SecurityLogPath); err != nil || info.Size() == 0 {
+		t.Errorf("Expected the event in a new log file: %v", err)
+	}
+
+	s.Close()
+	if err := s.Write(createTestSecurityEvent()); err != nil {
+		t.Errorf("Writing after Close should be discarded, got %s", err)
+	}
+}
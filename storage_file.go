@@ -0,0 +1,246 @@
+package teapot_hacker_isolation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStorage is MemoryStorage plus an append-only log of every change, replayed on startup,
+// for single-node deployments that should keep their bans across restarts without running Redis.
+// Rate limiter and burst state stay in memory only.
+//
+// Each router gets its own FileStorage, but they all share the fileLog of their storagePath.
+type FileStorage struct {
+	*fileLog
+}
+
+// fileLog is the state and log file behind one storagePath
+type fileLog struct {
+	*MemoryStorage
+	path string
+	// writeLock serializes changes and their log records, so the log replays in the same order
+	writeLock sync.Mutex
+	file      *os.File // nil once closed
+	appended  int      // records written since the last compaction
+	compactAt int
+	// sinceCopy holds the records written while a background compaction writes the new log, nil otherwise
+	sinceCopy   [][]byte
+	compactions sync.WaitGroup
+	// guarded by fileStoragesLock
+	refs        int
+	subscribers map[*FileStorage]fileSubscriber
+}
+
+type fileSubscriber struct {
+	onExpire func(key string, item StorageItem)
+	onError  func(error)
+}
+
+// fileStorages holds one fileLog per path, shared by every router (and config reload) using it:
+// two logs appending to the same file would interleave, and a compaction would orphan the other's handle.
+var (
+	fileStoragesLock sync.Mutex
+	fileStorages     = map[string]*fileLog{}
+)
+
+// NewFileStorage opens storagePath, or joins the router that already has it open. Every call needs a Close.
+// onExpire and onError (both optional) are told about expired entries and failed background compactions, every
+// router sharing the path hears about all of them.
+func NewFileStorage(config *Config, onExpire func(key string, item StorageItem), onError func(error)) (*FileStorage, error) {
+	if config.StoragePath == "" {
+		return nil, fmt.Errorf("storageSystem File needs storagePath")
+	}
+	path, err := filepath.Abs(config.StoragePath)
+	if err != nil {
+		return nil, err
+	}
+	fileStoragesLock.Lock()
+	defer fileStoragesLock.Unlock()
+	shared, ok := fileStorages[path]
+	if !ok {
+		shared = &fileLog{MemoryStorage: NewMemoryStorage(), path: path, subscribers: map[*FileStorage]fileSubscriber{}}
+		if err := shared.readSnapshot(shared.path); err != nil {
+			return nil, err
+		}
+		if err := shared.compact(); err != nil {
+			return nil, err
+		}
+		// set before anyone else can see it, nothing expires while loading
+		shared.OnExpire = shared.notifyExpired
+		fileStorages[path] = shared
+	}
+	f := &FileStorage{fileLog: shared}
+	shared.refs++
+	shared.subscribers[f] = fileSubscriber{onExpire: onExpire, onError: onError}
+	return f, nil
+}
+
+func (f *fileLog) currentSubscribers() []fileSubscriber {
+	fileStoragesLock.Lock()
+	defer fileStoragesLock.Unlock()
+	ret := make([]fileSubscriber, 0, len(f.subscribers))
+	for _, subscriber := range f.subscribers {
+		ret = append(ret, subscriber)
+	}
+	return ret
+}
+
+// notifyExpired runs under the MemoryStorage lock, so Close never waits for that lock while holding fileStoragesLock
+func (f *fileLog) notifyExpired(key string, item StorageItem) {
+	for _, subscriber := range f.currentSubscribers() {
+		if subscriber.onExpire != nil {
+			subscriber.onExpire(key, item)
+		}
+	}
+}
+
+// compact rewrites the log with only the live entries, the same way snapshots are written. Only used on load,
+// later compactions run in the background.
+func (f *fileLog) compact() error {
+	live, err := f.writeSnapshot(f.path)
+	if err != nil {
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file, err = os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	f.appended = 0
+	f.compactAt = 2*live + 1000
+	return nil
+}
+
+// append writes one record, must be called with writeLock held
+func (f *fileLog) append(line []byte) error {
+	if _, err := f.file.Write(line); err != nil {
+		return err
+	}
+	if f.sinceCopy != nil {
+		f.sinceCopy = append(f.sinceCopy, line)
+	}
+	f.appended++
+	if f.appended >= f.compactAt && f.sinceCopy == nil {
+		f.sinceCopy = [][]byte{}
+		f.compactions.Add(1)
+		go f.compactInBackground(f.live())
+	}
+	return nil
+}
+
+// compactInBackground writes live (copied when the compaction started) to a new log without holding writeLock,
+// then adds the records written meanwhile and swaps the new log in under the lock. If it fails the old log is kept.
+func (f *fileLog) compactInBackground(live map[string]StorageItem) {
+	defer f.compactions.Done()
+	out, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err == nil {
+		w := bufio.NewWriter(out)
+		for key, item := range live {
+			if err = writeSnapshotRecord(w, key, item); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		err = f.swapLog(out, err, len(live))
+	}
+	if err != nil {
+		f.compactionFailed(err)
+	}
+}
+
+// swapLog finishes the new log out and replaces the current one with it, or throws it away if writing it failed
+func (f *fileLog) swapLog(out *os.File, err error, live int) error {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+	for _, line := range f.sinceCopy {
+		if err != nil {
+			break
+		}
+		_, err = out.Write(line)
+	}
+	f.sinceCopy = nil
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil && f.file != nil {
+		err = os.Rename(out.Name(), f.path)
+	}
+	if err != nil || f.file == nil {
+		out.Close()
+		os.Remove(out.Name())
+		// try again after another batch of records
+		f.compactAt = f.appended + 1000
+		return err
+	}
+	syncDir(filepath.Dir(f.path))
+	// only this log writes to out, so it keeps appending where the copy ended
+	f.file.Close()
+	f.file = out
+	f.appended = 0
+	f.compactAt = 2*live + 1000
+	return nil
+}
+
+func (f *fileLog) compactionFailed(err error) {
+	for _, subscriber := range f.currentSubscribers() {
+		if subscriber.onError != nil {
+			subscriber.onError(err)
+		}
+	}
+}
+
+func (f *fileLog) IncrIpViolations(ip string, jailTime time.Duration, violation Violation) (StorageItem, error) {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+	item, err := f.MemoryStorage.IncrIpViolations(ip, jailTime, violation)
+	if err != nil {
+		return item, err
+	}
+	line := bytes.Buffer{}
+	if err := writeSnapshotRecord(&line, ip, item); err != nil {
+		return item, err
+	}
+	return item, f.append(line.Bytes())
+}
+
+func (f *fileLog) ResetIpViolations(ip string) error {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+	if err := f.MemoryStorage.ResetIpViolations(ip); err != nil {
+		return err
+	}
+	line, _ := json.Marshal(snapshotRecord{Key: ip, Deleted: true})
+	return f.append(append(line, '\n'))
+}
+
+// Close stops telling this router about expiries, and releases the file once the last router using it closes.
+// Every record is written as it happens so there's nothing to flush.
+func (f *FileStorage) Close() error {
+	fileStoragesLock.Lock()
+	delete(f.subscribers, f)
+	f.refs--
+	last := f.refs == 0
+	if last {
+		delete(fileStorages, f.path)
+	}
+	fileStoragesLock.Unlock()
+	if !last {
+		return nil
+	}
+	f.writeLock.Lock()
+	err := f.file.Close()
+	f.file = nil
+	f.writeLock.Unlock()
+	f.compactions.Wait()
+	return err
+}
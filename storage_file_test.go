@@ -0,0 +1,185 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStorageSurvivesRestart(t *testing.T) {
+	config := CreateConfig()
+	config.StoragePath = filepath.Join(t.TempDir(), "state.log")
+	storage, err := NewFileStorage(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418", Path: "/x", Time: time.Now()})
+	}
+	storage.IncrIpViolations("5.6.7.8", time.Minute, Violation{Reason: "status:418"})
+	storage.ResetIpViolations("5.6.7.8")
+	storage.IncrIpViolations("9.9.9.9", -time.Minute, Violation{Reason: "status:418"}) // already expired
+	storage.Close()
+
+	// a crash mid-write leaves a torn last line
+	f, _ := os.OpenFile(config.StoragePath, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"k":"1.2.3.4","c":9`)
+	f.Close()
+
+	storage, err = NewFileStorage(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if found, _ := storage.GetIpViolations("1.2.3.4"); found.count != 3 || found.reasons["status:418"] != 3 || len(found.recent) != 3 {
+		t.Errorf("Expected 1.2.3.4 to come back with 3 violations, got %+v", found)
+	}
+	if found, _ := storage.GetIpViolations("5.6.7.8"); found.count != 0 {
+		t.Errorf("Expected the reset entry to stay reset, got %d", found.count)
+	}
+	raw, _ := os.ReadFile(config.StoragePath)
+	if lines := strings.Count(string(raw), "\n"); lines != 1 {
+		t.Errorf("Expected the log to be compacted to the one live entry on load, got %d lines", lines)
+	}
+	if found, _ := storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"}); found.count != 4 {
+		t.Errorf("Expected writes to continue after a restart, got %d", found.count)
+	}
+}
+
+func TestFileStorageCompactsInTheBackground(t *testing.T) {
+	config := CreateConfig()
+	config.StoragePath = filepath.Join(t.TempDir(), "state.log")
+	storage, err := NewFileStorage(config, nil, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough writes for a few compactions, racing with them
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				storage.IncrIpViolations(fmt.Sprintf("10.0.0.%d", (i*1000+j)%10), time.Minute, Violation{Reason: "status:418"})
+			}
+		}(i)
+	}
+	wg.Wait()
+	storage.Close()
+
+	raw, _ := os.ReadFile(config.StoragePath)
+	if lines := strings.Count(string(raw), "\n"); lines >= 4000 {
+		t.Errorf("Expected the log to have been compacted, got %d lines", lines)
+	}
+	if leftover, _ := filepath.Glob(config.StoragePath + ".*.tmp"); len(leftover) != 0 {
+		t.Errorf("Expected no temporary files left, found %v", leftover)
+	}
+	storage, err = NewFileStorage(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	total := 0
+	for i := 0; i < 10; i++ {
+		found, _ := storage.GetIpViolations(fmt.Sprintf("10.0.0.%d", i))
+		total += found.count
+	}
+	if total != 4000 {
+		t.Errorf("Expected every write made during the compactions to be kept, got %d of 4000", total)
+	}
+}
+
+func TestFileStorageIsSharedPerPath(t *testing.T) {
+	config := CreateConfig()
+	config.StoragePath = filepath.Join(t.TempDir(), "state.log")
+	first, err := NewFileStorage(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewFileStorage(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.fileLog != second.fileLog {
+		t.Fatal("Expected both routers to share the storage for the same path")
+	}
+
+	// the first router going away (a config reload) mustn't close the log under the second
+	first.Close()
+	if _, err := second.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"}); err != nil {
+		t.Errorf("Expected writes to continue after the other router closed, got %s", err)
+	}
+	second.Close()
+
+	reopened, err := NewFileStorage(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.fileLog == first.fileLog {
+		t.Error("Expected the storage to be reloaded once every router closed it")
+	}
+	if found, _ := reopened.GetIpViolations("1.2.3.4"); found.count != 1 {
+		t.Errorf("Expected the write after the first close to be kept, got %d", found.count)
+	}
+}
+
+func TestFileStorageTellsEveryRouterAboutExpiries(t *testing.T) {
+	config := CreateTestConfig()
+	config.StorageSystem = "File"
+	config.StoragePath = filepath.Join(t.TempDir(), "state.log")
+	firstCtx, closeFirst := context.WithCancel(context.Background())
+	first, err := CreateTestPlugin(config, firstCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Storage.(*FileStorage).Close()
+	expireBan := func(ip string) {
+		// the last violation moves the expiry into the past
+		for i := 1; i <= config.MinInstances; i++ {
+			jail := time.Minute
+			if i == config.MinInstances {
+				jail = -time.Minute
+			}
+			first.Storage.IncrIpViolations(ip, jail, Violation{Reason: "status:418"})
+		}
+		ServeTestRequest(second, http.MethodGet, "http://localhost/innocent", ip, "")
+	}
+
+	expireBan("1.2.3.4")
+	if first.Metrics.Counter("teapot_unbans_total", "") != 1 || second.Metrics.Counter("teapot_unbans_total", "") != 1 {
+		t.Errorf("Expected both routers to see the unban, got %d and %d",
+			first.Metrics.Counter("teapot_unbans_total", ""), second.Metrics.Counter("teapot_unbans_total", ""))
+	}
+
+	// a reloaded-away router stops hearing about expiries
+	closeFirst()
+	for i := 0; i < 100 && len(fileSubscribers(second.Storage.(*FileStorage))) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expireBan("5.6.7.8")
+	if first.Metrics.Counter("teapot_unbans_total", "") != 1 || second.Metrics.Counter("teapot_unbans_total", "") != 2 {
+		t.Errorf("Expected only the remaining router to see the second unban, got %d and %d",
+			first.Metrics.Counter("teapot_unbans_total", ""), second.Metrics.Counter("teapot_unbans_total", ""))
+	}
+}
+
+func fileSubscribers(f *FileStorage) map[*FileStorage]fileSubscriber {
+	fileStoragesLock.Lock()
+	defer fileStoragesLock.Unlock()
+	ret := map[*FileStorage]fileSubscriber{}
+	for k, v := range f.subscribers {
+		ret[k] = v
+	}
+	return ret
+}
@@ -2,12 +2,47 @@ package teapot_hacker_isolation
 
 import "time"
 
+// how many recent violations are kept per key
+const maxRecentViolations = 10
+
+// how many distinct members the memory storage remembers per key, the count saturates there
+const maxDistinctMembers = 1000
+
 type IStorage interface {
-	GetIpViolations(ip string) StorageItem
-	IncrIpViolations(ip string, jailTime time.Duration) StorageItem
+	GetIpViolations(ip string) (StorageItem, error)
+	IncrIpViolations(ip string, jailTime time.Duration, violation Violation) (StorageItem, error)
+	ResetIpViolations(ip string) error
+	// AllowRate is a GCRA limiter: one request per interval on average, with up to burst at once
+	AllowRate(key string, interval time.Duration, burst int) (bool, error)
+	// TrackDistinct adds member to the set for key and returns how many distinct members it has seen
+	// since the set was started, sets expire window after their first member
+	TrackDistinct(key string, member string, window time.Duration) (int, error)
+	ResetDistinct(key string) error
+}
+
+// IBanRecorder is implemented by storages that keep a history of bans
+type IBanRecorder interface {
+	RecordBan(key string, reason string, path string, found StorageItem)
 }
 
 type StorageItem struct {
 	count   int
 	expires int64
+	reasons map[string]int // violations per reason, e.g. "status:405"
+	recent  []Violation    // most recent first, at most maxRecentViolations
+}
+
+// Violation is why (and where) a key was counted.
+type Violation struct {
+	Reason string    `json:"reason"`
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+	Weight int       `json:"weight,omitempty"` // how much it adds to the count, 0 means 1
+}
+
+func (v Violation) weight() int {
+	if v.Weight < 1 {
+		return 1
+	}
+	return v.Weight
 }
@@ -1,47 +1,191 @@
 package teapot_hacker_isolation
 
 import (
-	"os"
+	"sync"
 	"time"
 )
 
 type MemoryStorage struct {
 	cache map[string]StorageItem
+	// sweep expired entries once the cache grows past this, keys can come from client-chosen headers
+	cacheSweepAt int
+	rates        map[string]time.Time // GCRA theoretical arrival time per key
+	// sweep finished rate entries once the map grows past this
+	ratesSweepAt int
+	// paths (or other members) seen per key, swept like rates
+	distinct        map[string]*distinctSet
+	distinctSweepAt int
+	lock            sync.Mutex
+	// OnExpire (optional) is called when an expired entry is noticed and dropped
+	OnExpire func(ip string, item StorageItem)
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	ret := MemoryStorage{
-		cache: make(map[string]StorageItem),
+		cache:           make(map[string]StorageItem),
+		cacheSweepAt:    1024,
+		rates:           make(map[string]time.Time),
+		ratesSweepAt:    1024,
+		distinct:        make(map[string]*distinctSet),
+		distinctSweepAt: 1024,
 	}
 	return &ret
 }
 
-func (r *MemoryStorage) GetIpViolations(ip string) StorageItem {
-	for h, v := range r.cache {
-		if h == ip && v.expires >= time.Now().Unix() {
-			return v
+func (r *MemoryStorage) GetIpViolations(ip string) (StorageItem, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if v, ok := r.cache[ip]; ok {
+		if v.expires >= time.Now().Unix() {
+			return v.copy(), nil
 		}
+		r.expire(ip, v)
 	}
 	// TODO FIXME: kick off thread to GC old entries??
-	return StorageItem{}
+	return StorageItem{}, nil
 }
 
-func (r *MemoryStorage) IncrIpViolations(ip string, jailTime time.Duration) StorageItem {
+func (r *MemoryStorage) IncrIpViolations(ip string, jailTime time.Duration, violation Violation) (StorageItem, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	now := time.Now().Unix()
 	newExpires := now + int64(jailTime.Seconds())
-	for h, v := range r.cache {
-		if h == ip && v.expires >= now {
-			os.Stderr.WriteString("matched!\n")
-			v.count = v.count + 1
-			v.expires = newExpires
-			r.cache[ip] = v // set back into memory cache
-			return v
+	v, ok := r.cache[ip]
+	if ok && v.expires < now {
+		r.expire(ip, v)
+		ok = false
+	}
+	if !ok {
+		if len(r.cache) >= r.cacheSweepAt {
+			for k, item := range r.cache {
+				if item.expires < now {
+					r.expire(k, item)
+				}
+			}
+			r.cacheSweepAt = 2*len(r.cache) + 1024
+		}
+		v = StorageItem{reasons: make(map[string]int)}
+	}
+	v.count = v.count + violation.weight()
+	v.expires = newExpires
+	v.reasons[violation.Reason] += violation.weight()
+	v.recent = append([]Violation{violation}, v.recent...)
+	if len(v.recent) > maxRecentViolations {
+		v.recent = v.recent[:maxRecentViolations]
+	}
+	r.cache[ip] = v // set back into memory cache
+	return v.copy(), nil
+}
+
+func (r *MemoryStorage) ResetIpViolations(ip string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.cache, ip)
+	return nil
+}
+
+func (r *MemoryStorage) AllowRate(key string, interval time.Duration, burst int) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	tat, ok := r.rates[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(interval)
+	if newTat.Sub(now) > interval*time.Duration(burst) {
+		return false, nil
+	}
+	r.rates[key] = newTat
+	if len(r.rates) >= r.ratesSweepAt {
+		for k, t := range r.rates {
+			if t.Before(now) {
+				delete(r.rates, k)
+			}
+		}
+		r.ratesSweepAt = 2*len(r.rates) + 1024
+	}
+	return true, nil
+}
+
+type distinctSet struct {
+	expires time.Time
+	members map[string]struct{}
+}
+
+func (r *MemoryStorage) TrackDistinct(key string, member string, window time.Duration) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	set, ok := r.distinct[key]
+	if !ok || set.expires.Before(now) {
+		if !ok && len(r.distinct) >= r.distinctSweepAt {
+			for k, s := range r.distinct {
+				if s.expires.Before(now) {
+					delete(r.distinct, k)
+				}
+			}
+			r.distinctSweepAt = 2*len(r.distinct) + 1024
+		}
+		set = &distinctSet{expires: now.Add(window), members: make(map[string]struct{})}
+		r.distinct[key] = set
+	}
+	if len(set.members) < maxDistinctMembers {
+		set.members[member] = struct{}{}
+	}
+	return len(set.members), nil
+}
+
+func (r *MemoryStorage) ResetDistinct(key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.distinct, key)
+	return nil
+}
+
+// restore puts a previously saved item back, expired items are dropped
+func (r *MemoryStorage) restore(ip string, item StorageItem) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if item.expires < time.Now().Unix() {
+		delete(r.cache, ip)
+		return
+	}
+	if item.reasons == nil {
+		item.reasons = make(map[string]int)
+	}
+	r.cache[ip] = item
+}
+
+// live returns a copy of every unexpired item
+func (r *MemoryStorage) live() map[string]StorageItem {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now().Unix()
+	ret := make(map[string]StorageItem, len(r.cache))
+	for ip, v := range r.cache {
+		if v.expires >= now {
+			ret[ip] = v.copy()
 		}
 	}
-	ret := StorageItem{
-		count:   1,
-		expires: newExpires,
+	return ret
+}
+
+// must be called with lock held
+func (r *MemoryStorage) expire(ip string, item StorageItem) {
+	delete(r.cache, ip)
+	if r.OnExpire != nil {
+		r.OnExpire(ip, item)
+	}
+}
+
+// copy so callers never share the cached map/slice
+func (item StorageItem) copy() StorageItem {
+	ret := item
+	ret.reasons = make(map[string]int, len(item.reasons))
+	for k, v := range item.reasons {
+		ret.reasons[k] = v
 	}
-	r.cache[ip] = ret
+	ret.recent = append([]Violation{}, item.recent...)
 	return ret
 }
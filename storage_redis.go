@@ -1,6 +1,7 @@
 package teapot_hacker_isolation
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
@@ -39,35 +40,196 @@ func NewRedisStorage(config *Config) (*RedisStorage, error) {
 	}, nil
 }
 
-func (r *RedisStorage) GetIpViolations(ip string) StorageItem {
+func (r *RedisStorage) GetIpViolations(ip string) (StorageItem, error) {
 	var foundI int
 	key := r.buildRedisKey(ip)
 	found, err := r.redisConn.Get(key).Result()
 	ret := StorageItem{}
-	if err == nil {
-		foundI, err = strconv.Atoi(found)
-		if err == nil {
-			ret.count = foundI
-			t, _ := r.redisConn.TTL(key).Result()
-			ret.expires = time.Now().Unix() + int64(t.Seconds())
-		}
-		r.redisConn.TTL(key)
+	if err == redis.Nil {
+		return ret, nil // not found is not an error
+	}
+	if err != nil {
+		return ret, err
+	}
+	foundI, err = strconv.Atoi(found)
+	if err != nil {
+		return ret, err
 	}
-	return ret
+	ret.count = foundI
+	t, _ := r.redisConn.TTL(key).Result()
+	ret.expires = time.Now().Unix() + int64(t.Seconds())
+	reasons, _ := r.redisConn.HGetAll(r.buildRedisReasonsKey(ip)).Result()
+	recent, _ := r.redisConn.LRange(r.buildRedisRecentKey(ip), 0, maxRecentViolations-1).Result()
+	ret.reasons, ret.recent = decodeRedisReasons(reasons, recent)
+	return ret, nil
 }
 
-func (r *RedisStorage) IncrIpViolations(ip string, jailTime time.Duration) StorageItem {
+func (r *RedisStorage) IncrIpViolations(ip string, jailTime time.Duration, violation Violation) (StorageItem, error) {
 	ret := StorageItem{}
 	key := r.buildRedisKey(ip)
-	newVal, err := r.redisConn.Incr(key).Result()
-	if err == nil {
-		ret.count = int(newVal)
-		ret.expires = time.Now().Unix() + int64(jailTime.Seconds())
-		r.redisConn.ExpireAtUnix(key, ret.expires)
+	reasonsKey := r.buildRedisReasonsKey(ip)
+	recentKey := r.buildRedisRecentKey(ip)
+	encoded, err := json.Marshal(violation)
+	if err != nil {
+		return ret, err
+	}
+	expiresAt := time.Now().Add(jailTime).Truncate(time.Second)
+
+	pipe := r.redisConn.TxPipeline()
+	incr := pipe.IncrBy(key, int64(violation.weight()))
+	pipe.HIncrBy(reasonsKey, violation.Reason, int64(violation.weight()))
+	pipe.LPush(recentKey, string(encoded))
+	pipe.LTrim(recentKey, 0, maxRecentViolations-1)
+	for _, k := range []string{key, reasonsKey, recentKey} {
+		pipe.ExpireAt(k, expiresAt)
+	}
+	reasons := pipe.HGetAll(reasonsKey)
+	recent := pipe.LRange(recentKey, 0, maxRecentViolations-1)
+	if _, err := pipe.Exec(); err != nil {
+		return ret, err
+	}
+	ret.count = int(incr.Val())
+	ret.expires = expiresAt.Unix()
+	ret.reasons, ret.recent = decodeRedisReasons(reasons.Val(), recent.Val())
+	return ret, nil
+}
+
+// IncrBatch applies increments aggregated by WriteBehindStorage in a single (non-transactional) pipeline.
+// An entry only fails when its IncrBy did, the pipeline's first error says nothing about the others.
+func (r *RedisStorage) IncrBatch(batch []*pendingIncr) ([]StorageItem, []error) {
+	type batchCmds struct {
+		incr    *redis.IntCmd
+		reasons *redis.StringStringMapCmd
+		recent  *redis.StringSliceCmd
+	}
+	pipe := r.redisConn.Pipeline()
+	cmds := make([]batchCmds, len(batch))
+	for i, p := range batch {
+		key := r.buildRedisKey(p.key)
+		reasonsKey := r.buildRedisReasonsKey(p.key)
+		recentKey := r.buildRedisRecentKey(p.key)
+		cmds[i].incr = pipe.IncrBy(key, int64(p.count))
+		for reason, n := range p.reasons {
+			pipe.HIncrBy(reasonsKey, reason, int64(n))
+		}
+		// oldest first, so the newest ends up at the head like with IncrIpViolations
+		for j := len(p.recent) - 1; j >= 0; j-- {
+			encoded, err := json.Marshal(p.recent[j])
+			if err != nil {
+				return nil, batchErrors(len(batch), err)
+			}
+			pipe.LPush(recentKey, string(encoded))
+		}
+		pipe.LTrim(recentKey, 0, maxRecentViolations-1)
+		for _, k := range []string{key, reasonsKey, recentKey} {
+			pipe.ExpireAt(k, p.expires)
+		}
+		cmds[i].reasons = pipe.HGetAll(reasonsKey)
+		cmds[i].recent = pipe.LRange(recentKey, 0, maxRecentViolations-1)
+	}
+	pipe.Exec()
+	ret := make([]StorageItem, len(batch))
+	errs := make([]error, len(batch))
+	for i, p := range batch {
+		if err := cmds[i].incr.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		// the increment landed, if reading back reasons or recent failed they're just missing until the next write
+		ret[i].count = int(cmds[i].incr.Val())
+		ret[i].expires = p.expires.Unix()
+		ret[i].reasons, ret[i].recent = decodeRedisReasons(cmds[i].reasons.Val(), cmds[i].recent.Val())
+	}
+	return ret, errs
+}
+
+func (r *RedisStorage) ResetIpViolations(ip string) error {
+	return r.redisConn.Del(r.buildRedisKey(ip), r.buildRedisReasonsKey(ip), r.buildRedisRecentKey(ip)).Err()
+}
+
+// gcraScript runs the limiter atomically in redis, so every traefik instance shares the same bucket.
+// ARGV: now, interval and burst tolerance, all in microseconds so rates above 1000/s don't round to 0.
+// The expiry is rounded up to whole milliseconds for PX.
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+	tat = now
+end
+local newTat = tat + interval
+if newTat - now > tolerance then
+	return 0
+end
+redis.call("SET", KEYS[1], newTat, "PX", math.ceil((newTat - now) / 1000))
+return 1
+`)
+
+func (r *RedisStorage) AllowRate(key string, interval time.Duration, burst int) (bool, error) {
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	step := interval.Microseconds()
+	if step < 1 {
+		step = 1
 	}
-	return ret
+	allowed, err := gcraScript.Run(r.redisConn, []string{r.buildRedisRateKey(key)}, now, step, step*int64(burst)).Int()
+	return allowed == 1, err
+}
+
+// TrackDistinct uses a HyperLogLog, so memory stays bounded (12kB per key at most) however many paths are tried
+func (r *RedisStorage) TrackDistinct(key string, member string, window time.Duration) (int, error) {
+	hllKey := r.buildRedisDistinctKey(key)
+	pipe := r.redisConn.Pipeline()
+	pipe.PFAdd(hllKey, member)
+	count := pipe.PFCount(hllKey)
+	ttl := pipe.PTTL(hllKey)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	if ttl.Val() < 0 {
+		// first member, start the window
+		if err := r.redisConn.PExpire(hllKey, window).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return int(count.Val()), nil
+}
+
+func (r *RedisStorage) ResetDistinct(key string) error {
+	return r.redisConn.Del(r.buildRedisDistinctKey(key)).Err()
 }
 
 func (r *RedisStorage) buildRedisKey(ip string) string {
 	return "ip:" + ip
 }
+
+func (r *RedisStorage) buildRedisReasonsKey(ip string) string {
+	return "reasons:" + ip
+}
+
+func (r *RedisStorage) buildRedisRecentKey(ip string) string {
+	return "recent:" + ip
+}
+
+func (r *RedisStorage) buildRedisRateKey(key string) string {
+	return "rate:" + key
+}
+
+func (r *RedisStorage) buildRedisDistinctKey(key string) string {
+	return "distinct:" + key
+}
+
+func decodeRedisReasons(reasons map[string]string, recent []string) (map[string]int, []Violation) {
+	counts := make(map[string]int, len(reasons))
+	for reason, v := range reasons {
+		counts[reason], _ = strconv.Atoi(v)
+	}
+	violations := []Violation{}
+	for _, v := range recent {
+		violation := Violation{}
+		if json.Unmarshal([]byte(v), &violation) == nil {
+			violations = append(violations, violation)
+		}
+	}
+	return counts, violations
+}
@@ -0,0 +1,257 @@
+package teapot_hacker_isolation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snapshotRecord is one line of a snapshot or of the File storage log:
+// the full state of a key after a change, or its removal
+type snapshotRecord struct {
+	Key     string         `json:"k"`
+	Deleted bool           `json:"d,omitempty"`
+	Count   int            `json:"c,omitempty"`
+	Expires int64          `json:"e,omitempty"`
+	Reasons map[string]int `json:"r,omitempty"`
+	Recent  []Violation    `json:"v,omitempty"`
+}
+
+func writeSnapshotRecord(w io.Writer, key string, item StorageItem) error {
+	line, err := json.Marshal(snapshotRecord{Key: key, Count: item.count, Expires: item.expires, Reasons: item.reasons, Recent: item.recent})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// readSnapshot replays every record in path into r, a missing file is empty and a torn last line (crash mid-write) is ignored
+func (r *MemoryStorage) readSnapshot(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record := snapshotRecord{}
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		if record.Deleted {
+			r.ResetIpViolations(record.Key)
+			continue
+		}
+		r.restore(record.Key, StorageItem{count: record.Count, expires: record.Expires, reasons: record.Reasons, recent: record.Recent})
+	}
+	return scanner.Err()
+}
+
+// writeSnapshot writes every live entry to a new temporary file next to path, syncs it and renames it over path,
+// so a crash leaves either the old or the new snapshot, never half of one. Returns how many entries were written.
+func (r *MemoryStorage) writeSnapshot(path string) (int, error) {
+	// a unique temp file, so two writers of the same path can't truncate each other's half-written snapshot
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	tmp := out.Name()
+	live, err := r.writeSnapshotTo(out)
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	syncDir(filepath.Dir(path))
+	return live, nil
+}
+
+// writeSnapshotTo writes, syncs and closes out
+func (r *MemoryStorage) writeSnapshotTo(out *os.File) (int, error) {
+	w := bufio.NewWriter(out)
+	live := r.live()
+	for key, item := range live {
+		if err := writeSnapshotRecord(w, key, item); err != nil {
+			out.Close()
+			return 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return 0, err
+	}
+	return len(live), out.Close()
+}
+
+// LoadSnapshot restores the active bans and counts saved by SaveSnapshot, expired entries are discarded.
+func (r *MemoryStorage) LoadSnapshot(path string) error {
+	return r.readSnapshot(path)
+}
+
+func (r *MemoryStorage) SaveSnapshot(path string) error {
+	_, err := r.writeSnapshot(path)
+	return err
+}
+
+// SnapshotStorage is MemoryStorage saved to memorySnapshotPath. Each router gets its own SnapshotStorage, but every
+// router (and config reload) using the same path shares one MemoryStorage and one snapshot loop: separate ones would
+// overwrite each other's snapshots, and a reload would start over from the last one.
+type SnapshotStorage struct {
+	*snapshotMemory
+}
+
+// snapshotMemory is the state behind one memorySnapshotPath
+type snapshotMemory struct {
+	*MemoryStorage
+	path   string
+	done   chan struct{}
+	closed chan struct{}
+	// refs is guarded by memorySnapshotsLock. subscribers has its own lock, it's read under the MemoryStorage lock
+	// while the final snapshot is written under memorySnapshotsLock.
+	refs            int
+	subscribersLock sync.Mutex
+	subscribers     map[*SnapshotStorage]snapshotSubscriber
+}
+
+type snapshotSubscriber struct {
+	onExpire func(key string, item StorageItem)
+	onError  func(error)
+}
+
+var (
+	memorySnapshotsLock sync.Mutex
+	memorySnapshots     = map[string]*snapshotMemory{}
+)
+
+// NewSnapshotStorage loads config.MemorySnapshotPath, or joins the router that already has it loaded, and saves it
+// every interval (the first router's). Every call needs a Close. onExpire and onError (both optional) hear about
+// every expiry and every failed snapshot of the shared storage.
+func NewSnapshotStorage(config *Config, interval time.Duration, onExpire func(key string, item StorageItem), onError func(error)) (*SnapshotStorage, error) {
+	path, err := filepath.Abs(config.MemorySnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	memorySnapshotsLock.Lock()
+	defer memorySnapshotsLock.Unlock()
+	shared, ok := memorySnapshots[path]
+	if !ok {
+		shared = &snapshotMemory{MemoryStorage: NewMemoryStorage(), path: path, done: make(chan struct{}), closed: make(chan struct{}),
+			subscribers: map[*SnapshotStorage]snapshotSubscriber{}}
+		if err := shared.LoadSnapshot(path); err != nil {
+			return nil, err
+		}
+		shared.OnExpire = shared.notifyExpired
+		go shared.saveEvery(interval)
+		memorySnapshots[path] = shared
+	}
+	s := &SnapshotStorage{snapshotMemory: shared}
+	shared.refs++
+	shared.subscribersLock.Lock()
+	shared.subscribers[s] = snapshotSubscriber{onExpire: onExpire, onError: onError}
+	shared.subscribersLock.Unlock()
+	return s, nil
+}
+
+func (m *snapshotMemory) currentSubscribers() []snapshotSubscriber {
+	m.subscribersLock.Lock()
+	defer m.subscribersLock.Unlock()
+	ret := make([]snapshotSubscriber, 0, len(m.subscribers))
+	for _, subscriber := range m.subscribers {
+		ret = append(ret, subscriber)
+	}
+	return ret
+}
+
+func (m *snapshotMemory) notifyExpired(key string, item StorageItem) {
+	for _, subscriber := range m.currentSubscribers() {
+		if subscriber.onExpire != nil {
+			subscriber.onExpire(key, item)
+		}
+	}
+}
+
+func (m *snapshotMemory) saveEvery(interval time.Duration) {
+	defer close(m.closed)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			if err := m.SaveSnapshot(m.path); err != nil {
+				for _, subscriber := range m.currentSubscribers() {
+					if subscriber.onError != nil {
+						subscriber.onError(err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Close stops telling this router about expiries and errors. The last router using the path stops the loop and
+// saves a final snapshot, before a router joining the path can load it.
+func (s *SnapshotStorage) Close() error {
+	s.subscribersLock.Lock()
+	delete(s.subscribers, s)
+	s.subscribersLock.Unlock()
+	memorySnapshotsLock.Lock()
+	defer memorySnapshotsLock.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(memorySnapshots, s.path)
+	close(s.done)
+	<-s.closed
+	return s.SaveSnapshot(s.path)
+}
+
+// StartSnapshots saves a snapshot every interval, and a last one when ctx is done.
+func (r *MemoryStorage) StartSnapshots(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if err := r.SaveSnapshot(path); err != nil {
+					onError(err)
+				}
+				return
+			case <-ticker.C:
+				if err := r.SaveSnapshot(path); err != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// syncDir makes the rename durable, not supported everywhere so errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,133 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemorySnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	memory := NewMemoryStorage()
+	memory.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418", Path: "/x", Time: time.Now()})
+	memory.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "header:X-Teapot-Detected", Path: "/y", Time: time.Now()})
+	memory.IncrIpViolations("9.9.9.9", -time.Minute, Violation{Reason: "status:418"})
+	ctx, cancel := context.WithCancel(context.Background())
+	memory.StartSnapshots(ctx, path, time.Hour, func(err error) { t.Error(err) })
+	cancel() // the last snapshot is written on shutdown
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	restored := NewMemoryStorage()
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := restored.GetIpViolations("1.2.3.4"); found.count != 2 || found.reasons["header:X-Teapot-Detected"] != 1 || found.recent[0].Path != "/y" {
+		t.Errorf("Expected 1.2.3.4 to be restored, got %+v", found)
+	}
+	if len(restored.live()) != 1 {
+		t.Errorf("Expected expired entries to be discarded, got %d entries", len(restored.live()))
+	}
+	if leftover, _ := filepath.Glob(path + ".*.tmp"); len(leftover) != 0 {
+		t.Errorf("Expected the temporary file to be renamed away, found %v", leftover)
+	}
+	if err := NewMemoryStorage().LoadSnapshot(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("A missing snapshot should just mean empty, got %v", err)
+	}
+}
+
+func TestConcurrentSavesOfTheSamePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	memory := NewMemoryStorage()
+	for i := 0; i < 500; i++ {
+		memory.IncrIpViolations(fmt.Sprintf("10.0.%d.%d", i/256, i%256), time.Minute, Violation{Reason: "status:418"})
+	}
+
+	// saves racing on the same path mustn't truncate each other's temporary file
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := memory.SaveSnapshot(path); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	restored := NewMemoryStorage()
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.live()) != 500 {
+		t.Errorf("Expected a complete snapshot, got %d entries", len(restored.live()))
+	}
+}
+
+func TestRoutersShareTheSnapshotOfTheirPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	config := CreateTestConfig()
+	config.MemorySnapshotPath = path
+	config.SnapshotIntervalSeconds = 3600
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	first, err := CreateTestPlugin(config, firstCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	second, err := CreateTestPlugin(config, secondCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Storage.(*SnapshotStorage).snapshotMemory != second.Storage.(*SnapshotStorage).snapshotMemory {
+		t.Fatal("Expected both routers to share the storage of their snapshot path")
+	}
+
+	for i := 0; i < config.MinInstances; i++ {
+		ServeTestRequest(first, http.MethodGet, "http://localhost/418-please", "1.2.3.4", "")
+		ServeTestRequest(second, http.MethodGet, "http://localhost/418-please", "5.6.7.8", "")
+	}
+	// the first router going away (a reload) leaves its bans with the second, and doesn't save over them
+	cancelFirst()
+	for i := 0; i < 100 && memorySnapshotRefs(path) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := ServeTestRequest(second, http.MethodGet, "http://localhost/innocent", "1.2.3.4", "").Code; code != 418 {
+		t.Errorf("Expected the first router's ban to survive it, got %d", code)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected no snapshot while a router still uses the path")
+	}
+
+	cancelSecond()
+	for i := 0; i < 100 && memorySnapshotRefs(path) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	restored := NewMemoryStorage()
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.live()) != 2 {
+		t.Errorf("Expected the last router to save both routers' bans, got %d entries", len(restored.live()))
+	}
+}
+
+func memorySnapshotRefs(path string) int {
+	memorySnapshotsLock.Lock()
+	defer memorySnapshotsLock.Unlock()
+	if shared, ok := memorySnapshots[path]; ok {
+		return shared.refs
+	}
+	return 0
+}
@@ -0,0 +1,428 @@
+package teapot_hacker_isolation
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlMigrations are applied in order on startup, each one exactly once (tracked in teapot_schema_version).
+// Stick to SQL that SQLite (3.35+) and PostgreSQL both understand.
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS teapot_counters (
+		key VARCHAR(512) PRIMARY KEY,
+		count INTEGER NOT NULL,
+		expires BIGINT NOT NULL,
+		started BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS teapot_reasons (
+		key VARCHAR(512) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		count INTEGER NOT NULL,
+		expires BIGINT NOT NULL,
+		PRIMARY KEY (key, reason)
+	)`,
+	`CREATE TABLE IF NOT EXISTS teapot_history (
+		key VARCHAR(512) NOT NULL,
+		event VARCHAR(32) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		path TEXT NOT NULL,
+		at BIGINT NOT NULL,
+		count INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS teapot_history_key_at ON teapot_history (key, at)`,
+}
+
+// how many history rows are queued for the background writer before new ones are dropped
+const sqlHistoryQueueSize = 10000
+
+type sqlHistoryRow struct {
+	key    string
+	event  string // violation, ban or reset
+	reason string
+	path   string
+	at     int64
+	count  int
+}
+
+// SqlStorage keeps the counters in a relational database through database/sql, plus an append-only
+// history of violations, bans and resets for reporting. Counters are updated synchronously, history rows
+// are written in batches by a background goroutine. Rate limiter and burst state stay in this process.
+//
+// No driver is bundled (Traefik plugins can't load one), so sqlDriver must name a driver registered
+// by the binary embedding this package, e.g. "sqlite" or "postgres".
+type SqlStorage struct {
+	*MemoryStorage // only for AllowRate / TrackDistinct
+	db             *sql.DB
+	dollar         bool // postgres style $1 placeholders instead of ?
+	history        chan sqlHistoryRow
+	retention      time.Duration
+	dropped        int64
+	droppedLock    sync.Mutex
+	onError        func(operation string, err error, rows int)
+	done           chan struct{}
+	closed         chan struct{}
+}
+
+// errHistoryQueueFull is reported for history rows dropped because the writer fell behind
+var errHistoryQueueFull = errors.New("history queue full")
+
+// NewSqlStorage connects and migrates. onError (optional) is told about every background failure, with
+// the operation ("history" for a batch that couldn't be written, "history_dropped" or "prune") and how many
+// history rows were lost.
+func NewSqlStorage(config *Config, onError func(operation string, err error, rows int)) (*SqlStorage, error) {
+	if config.SqlDriver == "" || config.SqlDsn == "" {
+		return nil, fmt.Errorf("storageSystem SQL needs sqlDriver and sqlDsn")
+	}
+	db, err := sql.Open(config.SqlDriver, config.SqlDsn)
+	if err != nil {
+		return nil, fmt.Errorf("sql storage: %w (is the %s driver compiled in?)", err, config.SqlDriver)
+	}
+	s := &SqlStorage{
+		MemoryStorage: NewMemoryStorage(),
+		db:            db,
+		dollar:        strings.HasPrefix(config.SqlDriver, "postgres") || config.SqlDriver == "pgx",
+		history:       make(chan sqlHistoryRow, sqlHistoryQueueSize),
+		retention:     time.Duration(config.SqlHistoryRetentionDays) * 24 * time.Hour,
+		onError:       onError,
+		done:          make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.writeHistory()
+	return s, nil
+}
+
+// rebind turns ? placeholders into $1, $2, ... for postgres
+func (s *SqlStorage) rebind(query string) string {
+	if !s.dollar {
+		return query
+	}
+	sb := strings.Builder{}
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// migrate applies the missing migrations. Instances starting together don't step on each other: each migration
+// claims its version (the primary key) first, so a second instance waits for the first to commit, fails to claim
+// it, and moves on to whatever is still missing.
+func (s *SqlStorage) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS teapot_schema_version (version INTEGER PRIMARY KEY)`); err != nil {
+		// another instance may have created it at the same moment
+		if _, err2 := s.schemaVersion(); err2 != nil {
+			return fmt.Errorf("sql storage: %w", err)
+		}
+	}
+	for {
+		version, err := s.schemaVersion()
+		if err != nil {
+			return fmt.Errorf("sql storage: %w", err)
+		}
+		if version >= len(sqlMigrations) {
+			return nil
+		}
+		if err := s.applyMigration(version); err != nil {
+			if current, err2 := s.schemaVersion(); err2 == nil && current > version {
+				continue // another instance applied it
+			}
+			return fmt.Errorf("sql storage migration %d: %w", version+1, err)
+		}
+	}
+}
+
+func (s *SqlStorage) schemaVersion() (int, error) {
+	var version sql.NullInt64
+	err := s.db.QueryRow(`SELECT MAX(version) FROM teapot_schema_version`).Scan(&version)
+	return int(version.Int64), err
+}
+
+// applyMigration runs sqlMigrations[i] and records version i+1, in one transaction
+func (s *SqlStorage) applyMigration(i int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.rebind(`INSERT INTO teapot_schema_version (version) VALUES (?)`), i+1); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqlMigrations[i]); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqlStorage) GetIpViolations(ip string) (StorageItem, error) {
+	ret := StorageItem{}
+	now := time.Now().Unix()
+	var started int64
+	err := s.db.QueryRow(s.rebind(`SELECT count, expires, started FROM teapot_counters WHERE key = ? AND expires >= ?`), ip, now).Scan(&ret.count, &ret.expires, &started)
+	if err == sql.ErrNoRows {
+		return StorageItem{}, nil // not found is not an error
+	}
+	if err != nil {
+		return StorageItem{}, err
+	}
+	if ret.reasons, err = s.reasons(s.db, ip, now); err != nil {
+		return ret, err
+	}
+	ret.recent, err = s.recent(ip, started)
+	return ret, err
+}
+
+// IncrIpViolations upserts the counter and its reason in one transaction, both restart from zero once expired.
+func (s *SqlStorage) IncrIpViolations(ip string, jailTime time.Duration, violation Violation) (StorageItem, error) {
+	ret := StorageItem{}
+	now := time.Now().Unix()
+	expires := time.Now().Add(jailTime).Unix()
+	at := violation.Time.Unix()
+	if violation.Time.IsZero() {
+		at = now
+	}
+	var started int64
+	weight := violation.weight()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ret, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(s.rebind(`INSERT INTO teapot_counters (key, count, expires, started) VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN teapot_counters.expires < ? THEN excluded.count ELSE teapot_counters.count + excluded.count END,
+			started = CASE WHEN teapot_counters.expires < ? THEN excluded.started ELSE teapot_counters.started END,
+			expires = excluded.expires
+		RETURNING count, started`), ip, weight, expires, at, now, now).Scan(&ret.count, &started)
+	if err != nil {
+		return ret, err
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO teapot_reasons (key, reason, count, expires) VALUES (?, ?, ?, ?)
+		ON CONFLICT (key, reason) DO UPDATE SET
+			count = CASE WHEN teapot_reasons.expires < ? THEN excluded.count ELSE teapot_reasons.count + excluded.count END,
+			expires = excluded.expires`), ip, violation.Reason, weight, expires, now)
+	if err != nil {
+		return ret, err
+	}
+	// older reasons of the same key share its expiry
+	if _, err = tx.Exec(s.rebind(`UPDATE teapot_reasons SET expires = ? WHERE key = ? AND expires >= ?`), expires, ip, now); err != nil {
+		return ret, err
+	}
+	if ret.reasons, err = s.reasons(tx, ip, now); err != nil {
+		return ret, err
+	}
+	if err = tx.Commit(); err != nil {
+		return ret, err
+	}
+	ret.expires = expires
+	s.queueHistory(sqlHistoryRow{key: ip, event: "violation", reason: violation.Reason, path: violation.Path, at: at, count: ret.count})
+	ret.recent, err = s.recent(ip, started)
+	if len(ret.recent) == 0 || ret.recent[0].Reason != violation.Reason || ret.recent[0].Path != violation.Path || ret.recent[0].Time.Unix() != at {
+		// the history writer hasn't caught up yet
+		ret.recent = append([]Violation{violation}, ret.recent...)
+		if len(ret.recent) > maxRecentViolations {
+			ret.recent = ret.recent[:maxRecentViolations]
+		}
+	}
+	return ret, err
+}
+
+func (s *SqlStorage) ResetIpViolations(ip string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.rebind(`DELETE FROM teapot_counters WHERE key = ?`), ip); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind(`DELETE FROM teapot_reasons WHERE key = ?`), ip); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.queueHistory(sqlHistoryRow{key: ip, event: "reset", at: time.Now().Unix()})
+	return nil
+}
+
+// RecordBan adds a ban to the history, called by the plugin whenever a key crosses its threshold
+func (s *SqlStorage) RecordBan(key string, reason string, path string, found StorageItem) {
+	s.queueHistory(sqlHistoryRow{key: key, event: "ban", reason: reason, path: path, at: time.Now().Unix(), count: found.count})
+}
+
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *SqlStorage) reasons(q sqlQuerier, ip string, now int64) (map[string]int, error) {
+	rows, err := q.Query(s.rebind(`SELECT reason, count FROM teapot_reasons WHERE key = ? AND expires >= ?`), ip, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reasons := make(map[string]int)
+	for rows.Next() {
+		var reason string
+		var count int
+		if err := rows.Scan(&reason, &count); err != nil {
+			return nil, err
+		}
+		reasons[reason] = count
+	}
+	return reasons, rows.Err()
+}
+
+// recent reads the latest violations of the current count from the history: since it started
+// (violations from before the counter last expired don't belong to it), and since the last reset
+func (s *SqlStorage) recent(ip string, started int64) ([]Violation, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT event, reason, path, at FROM teapot_history WHERE key = ? AND at >= ? AND event IN ('violation', 'reset') ORDER BY at DESC LIMIT ?`), ip, started, maxRecentViolations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recent := []Violation{}
+	for rows.Next() {
+		var event, reason, path string
+		var at int64
+		if err := rows.Scan(&event, &reason, &path, &at); err != nil {
+			return nil, err
+		}
+		if event == "reset" {
+			break
+		}
+		recent = append(recent, Violation{Reason: reason, Path: path, Time: time.Unix(at, 0)})
+	}
+	return recent, rows.Err()
+}
+
+// queueHistory never blocks the request, rows are dropped (and counted) when the writer falls behind
+func (s *SqlStorage) queueHistory(row sqlHistoryRow) {
+	select {
+	case s.history <- row:
+	default:
+		s.droppedLock.Lock()
+		s.dropped++
+		s.droppedLock.Unlock()
+	}
+}
+
+// Dropped is how many history rows were lost because the queue was full
+func (s *SqlStorage) Dropped() int64 {
+	s.droppedLock.Lock()
+	defer s.droppedLock.Unlock()
+	return s.dropped
+}
+
+// writeHistory inserts queued rows in batches (every second, or every 100 rows) and prunes expired counters
+// and, if sqlHistoryRetentionDays is set, old history once a minute.
+func (s *SqlStorage) writeHistory() {
+	defer close(s.closed)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+	batch := []sqlHistoryRow{}
+	var reportedDropped int64
+	write := func() {
+		if err := s.insertHistory(batch); err != nil {
+			s.reportError("history", err, len(batch))
+		}
+		batch = batch[:0]
+		if dropped := s.Dropped(); dropped > reportedDropped {
+			s.reportError("history_dropped", errHistoryQueueFull, int(dropped-reportedDropped))
+			reportedDropped = dropped
+		}
+	}
+	for {
+		select {
+		case row := <-s.history:
+			batch = append(batch, row)
+			if len(batch) >= 100 {
+				write()
+			}
+		case <-flush.C:
+			write()
+		case <-prune.C:
+			if err := s.prune(); err != nil {
+				s.reportError("prune", err, 0)
+			}
+		case <-s.done:
+			// drain what's already queued, anything queued after Close is lost
+			for {
+				select {
+				case row := <-s.history:
+					batch = append(batch, row)
+				default:
+					write()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *SqlStorage) reportError(operation string, err error, rows int) {
+	if s.onError != nil {
+		s.onError(operation, err, rows)
+	}
+}
+
+// insertHistory writes the batch in one transaction, all or nothing
+func (s *SqlStorage) insertHistory(batch []sqlHistoryRow) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(s.rebind(`INSERT INTO teapot_history (key, event, reason, path, at, count) VALUES (?, ?, ?, ?, ?, ?)`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range batch {
+		if _, err := stmt.Exec(row.key, row.event, row.reason, row.path, row.at, row.count); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SqlStorage) prune() error {
+	now := time.Now().Unix()
+	if _, err := s.db.Exec(s.rebind(`DELETE FROM teapot_counters WHERE expires < ?`), now); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(s.rebind(`DELETE FROM teapot_reasons WHERE expires < ?`), now); err != nil {
+		return err
+	}
+	if s.retention > 0 {
+		if _, err := s.db.Exec(s.rebind(`DELETE FROM teapot_history WHERE at < ?`), time.Now().Add(-s.retention).Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the queued history and closes the database
+func (s *SqlStorage) Close() error {
+	close(s.done)
+	<-s.closed
+	return s.db.Close()
+}
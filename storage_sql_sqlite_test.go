@@ -0,0 +1,184 @@
+//go:build sqlite
+
+package teapot_hacker_isolation
+
+// These run SqlStorage against a real SQLite, which Traefik can't load, so they need the driver and the tag:
+//   go get modernc.org/sqlite && go test -tags sqlite ./...
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func createSqliteConfig(t *testing.T) *Config {
+	config := CreateTestConfig()
+	config.StorageSystem = "SQL"
+	config.SqlDriver = "sqlite"
+	config.SqlDsn = "file:" + filepath.Join(t.TempDir(), "teapot.db") + "?_pragma=busy_timeout(5000)"
+	return config
+}
+
+func TestSqliteStorage(t *testing.T) {
+	config := createSqliteConfig(t)
+	config.SqlHistoryRetentionDays = 1
+	storage, err := NewSqlStorage(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418", Path: "/a", Time: now})
+	found, err := storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "header:X-Teapot-Detected", Path: "/b", Time: now, Weight: 2})
+	if err != nil || found.count != 3 || found.reasons["status:418"] != 1 || found.reasons["header:X-Teapot-Detected"] != 2 || found.recent[0].Path != "/b" {
+		t.Errorf("Unexpected counter after two violations: %+v %v", found, err)
+	}
+	storage.RecordBan("1.2.3.4", "header:X-Teapot-Detected", "/b", found)
+
+	// the counter expired before the second violation, so it (and its reasons) start over
+	storage.IncrIpViolations("5.6.7.8", -time.Minute, Violation{Reason: "status:418", Path: "/old", Time: now.Add(-time.Hour)})
+	if found, _ = storage.IncrIpViolations("5.6.7.8", time.Minute, Violation{Reason: "status:418", Path: "/new", Time: now}); found.count != 1 || found.reasons["status:418"] != 1 {
+		t.Errorf("Expected the expired counter to restart, got %+v", found)
+	}
+
+	storage.IncrIpViolations("9.9.9.9", -time.Minute, Violation{Reason: "status:418", Path: "/ancient", Time: now.Add(-72 * time.Hour)})
+	storage.ResetIpViolations("9.9.9.9")
+
+	// Close writes the queued history, a second instance on the same database skips the migrations
+	storage.Close()
+	storage, err = NewSqlStorage(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	var versions, history, bans int
+	storage.db.QueryRow(`SELECT COUNT(*) FROM teapot_schema_version`).Scan(&versions)
+	storage.db.QueryRow(`SELECT COUNT(*) FROM teapot_history`).Scan(&history)
+	storage.db.QueryRow(`SELECT COUNT(*) FROM teapot_history WHERE event = 'ban' AND key = '1.2.3.4' AND count = 3`).Scan(&bans)
+	if versions != len(sqlMigrations) || history != 7 || bans != 1 {
+		t.Errorf("Expected %d migrations and 7 history rows with the ban, got %d, %d and %d", len(sqlMigrations), versions, history, bans)
+	}
+
+	found, _ = storage.GetIpViolations("1.2.3.4")
+	if found.count != 3 || len(found.recent) != 2 || found.recent[0].Path != "/b" || found.recent[1].Path != "/a" {
+		t.Errorf("Expected the counter and its history back, got %+v", found)
+	}
+	found, _ = storage.GetIpViolations("5.6.7.8")
+	if found.count != 1 || len(found.recent) != 1 || found.recent[0].Path != "/new" {
+		t.Errorf("Expected recent violations to stop where the counter expired, got %+v", found)
+	}
+	if found, _ = storage.GetIpViolations("9.9.9.9"); found.count != 0 {
+		t.Errorf("Expected the reset counter to stay reset, got %d", found.count)
+	}
+
+	storage.prune()
+	var counters, ancient int
+	storage.db.QueryRow(`SELECT COUNT(*) FROM teapot_counters`).Scan(&counters)
+	storage.db.QueryRow(`SELECT COUNT(*) FROM teapot_history WHERE at < ?`, now.Add(-24*time.Hour).Unix()).Scan(&ancient)
+	if counters != 2 || ancient != 0 {
+		t.Errorf("Expected pruning to leave 2 live counters and no history past the retention, got %d and %d", counters, ancient)
+	}
+}
+
+func TestSqliteFailedMigrationIsRolledBack(t *testing.T) {
+	config := createSqliteConfig(t)
+	migrations := sqlMigrations
+	defer func() { sqlMigrations = migrations }()
+	sqlMigrations = append(append([]string{}, migrations...), `CREATE TABLE teapot_counters (key INTEGER)`)
+
+	if _, err := NewSqlStorage(config, nil); err == nil {
+		t.Fatal("Expected the broken migration to fail")
+	}
+	db, err := sql.Open(config.SqlDriver, config.SqlDsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version int
+	db.QueryRow(`SELECT MAX(version) FROM teapot_schema_version`).Scan(&version)
+	if version != len(migrations) {
+		t.Errorf("Expected the failed migration's version to be rolled back, got %d", version)
+	}
+
+	sqlMigrations = migrations
+	storage, err := NewSqlStorage(config, nil)
+	if err != nil {
+		t.Fatalf("Expected a later start with the fixed migrations to succeed, got %v", err)
+	}
+	storage.Close()
+}
+
+func TestSqliteInstancesStartingTogether(t *testing.T) {
+	config := createSqliteConfig(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			storage, err := NewSqlStorage(config, nil)
+			if err == nil {
+				storage.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected every instance to start, got %v", err)
+		}
+	}
+}
+
+func TestSqliteStorageClosesWithTheRouter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	newPlugin, err := CreateTestPlugin(createSqliteConfig(t), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := newPlugin.Storage.(*SqlStorage)
+	cancel()
+	select {
+	case <-storage.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the history writer to stop when the router goes away")
+	}
+	for i := 0; i < 100 && storage.db.Ping() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := storage.db.Ping(); err == nil {
+		t.Error("Expected the database to be closed")
+	}
+}
+
+func TestSqliteHistoryErrorsAreReported(t *testing.T) {
+	config := createSqliteConfig(t)
+	var lock sync.Mutex
+	failed := map[string]int{}
+	storage, err := NewSqlStorage(config, func(operation string, err error, rows int) {
+		lock.Lock()
+		defer lock.Unlock()
+		failed[operation] += rows
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.db.Exec(`DROP TABLE teapot_history`); err != nil {
+		t.Fatal(err)
+	}
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418", Path: "/a", Time: time.Now()})
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418", Path: "/b", Time: time.Now()})
+	storage.Close()
+	lock.Lock()
+	defer lock.Unlock()
+	if failed["history"] != 2 {
+		t.Errorf("Expected the 2 unwritable history rows to be reported, got %v", failed)
+	}
+}
@@ -0,0 +1,24 @@
+package teapot_hacker_isolation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSqlStorageConfig(t *testing.T) {
+	config := CreateConfig()
+	config.StorageSystem = "SQL"
+	if _, err := NewSqlStorage(config, nil); err == nil || !strings.Contains(err.Error(), "sqlDriver") {
+		t.Errorf("Expected an error asking for sqlDriver, got %v", err)
+	}
+	// no driver is linked into the tests, which is exactly what happens under Traefik
+	config.SqlDriver, config.SqlDsn = "postgres", "postgres://teapot@db/teapot"
+	if _, err := NewSqlStorage(config, nil); err == nil || !strings.Contains(err.Error(), "driver compiled in") {
+		t.Errorf("Expected an unknown driver error, got %v", err)
+	}
+
+	s := &SqlStorage{dollar: true}
+	if q := s.rebind(`SELECT count FROM teapot_counters WHERE key = ? AND expires >= ?`); q != `SELECT count FROM teapot_counters WHERE key = $1 AND expires >= $2` {
+		t.Errorf("Unexpected postgres query %s", q)
+	}
+}
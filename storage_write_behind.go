@@ -0,0 +1,281 @@
+package teapot_hacker_isolation
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingIncr is everything counted against one key since the last flush
+type pendingIncr struct {
+	key     string
+	count   int
+	reasons map[string]int
+	recent  []Violation // newest first
+	expires time.Time
+}
+
+// IBatchIncrementer is a storage that can apply many increments in one round trip
+type IBatchIncrementer interface {
+	IStorage
+	// IncrBatch applies every pending increment and returns the resulting items and an error per entry, in the same
+	// order. A failed entry must not have been counted, it is retried with the next flush.
+	IncrBatch(batch []*pendingIncr) ([]StorageItem, []error)
+}
+
+// batchErrors fails every entry of a batch with err
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+type writeBehindEntry struct {
+	base     StorageItem  // last state known from the backend
+	inflight *pendingIncr // being flushed right now
+	pending  *pendingIncr // waiting for the next flush
+}
+
+// WriteBehindStorage aggregates increments in memory and flushes them every interval as one batch,
+// so a flagged request doesn't wait on the backend. Counts returned to ServeHTTP are the local view
+// (last known backend state plus what's still unflushed), so bans are still enforced immediately.
+//
+// Loss semantics: at most maxPending keys wait for a flush, further keys are written synchronously.
+// A failed flush is retried with the next one. Whatever can't be flushed on Close is lost (and reported).
+type WriteBehindStorage struct {
+	inner      IBatchIncrementer
+	interval   time.Duration
+	maxPending int
+	lock       sync.Mutex
+	local      map[string]*writeBehindEntry
+	pending    int // keys with a pending increment
+	// OnFlushError (optional) is told about every flush with failed keys, with the first error and how many keys failed
+	OnFlushError func(err error, keys int)
+	flushLock    sync.Mutex // one flush at a time
+	done         chan struct{}
+	closed       chan struct{}
+}
+
+func NewWriteBehindStorage(inner IBatchIncrementer, interval time.Duration, maxPending int) *WriteBehindStorage {
+	if maxPending <= 0 {
+		maxPending = 10000
+	}
+	w := &WriteBehindStorage{
+		inner:      inner,
+		interval:   interval,
+		maxPending: maxPending,
+		local:      make(map[string]*writeBehindEntry),
+		done:       make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *WriteBehindStorage) run() {
+	defer close(w.closed)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			w.Flush()
+			return
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// GetIpViolations reads the backend (other instances count too) and adds what this instance hasn't flushed yet.
+func (w *WriteBehindStorage) GetIpViolations(ip string) (StorageItem, error) {
+	found, err := w.inner.GetIpViolations(ip)
+	if err != nil {
+		return found, err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	e, ok := w.local[ip]
+	if !ok {
+		if found.count == 0 {
+			return found, nil // only remember keys with something to remember
+		}
+		e = &writeBehindEntry{}
+		w.local[ip] = e
+	}
+	if e.inflight == nil {
+		// while a flush is in flight the backend may or may not include it, keep the flush result instead
+		e.base = found
+	}
+	return w.view(e), nil
+}
+
+func (w *WriteBehindStorage) IncrIpViolations(ip string, jailTime time.Duration, violation Violation) (StorageItem, error) {
+	w.lock.Lock()
+	e, ok := w.local[ip]
+	if !ok {
+		e = &writeBehindEntry{}
+		w.local[ip] = e
+	}
+	if e.base.expires < time.Now().Unix() {
+		e.base = StorageItem{}
+	}
+	if e.pending == nil {
+		if w.pending >= w.maxPending {
+			// queue full: don't drop it, just don't defer it
+			w.lock.Unlock()
+			found, err := w.inner.IncrIpViolations(ip, jailTime, violation)
+			if err == nil {
+				w.lock.Lock()
+				if e.inflight == nil {
+					e.base = found
+				}
+				found = w.view(e)
+				w.lock.Unlock()
+			}
+			return found, err
+		}
+		e.pending = &pendingIncr{key: ip, reasons: make(map[string]int)}
+		w.pending++
+	}
+	p := e.pending
+	p.count += violation.weight()
+	p.reasons[violation.Reason] += violation.weight()
+	p.recent = append([]Violation{violation}, p.recent...)
+	if len(p.recent) > maxRecentViolations {
+		p.recent = p.recent[:maxRecentViolations]
+	}
+	p.expires = time.Now().Add(jailTime).Truncate(time.Second)
+	ret := w.view(e)
+	w.lock.Unlock()
+	return ret, nil
+}
+
+// view is the backend state plus everything not flushed yet, must be called with lock held
+func (w *WriteBehindStorage) view(e *writeBehindEntry) StorageItem {
+	ret := e.base.copy()
+	for _, p := range []*pendingIncr{e.inflight, e.pending} {
+		if p == nil {
+			continue
+		}
+		ret.count += p.count
+		if p.expires.Unix() > ret.expires {
+			ret.expires = p.expires.Unix()
+		}
+		for reason, n := range p.reasons {
+			ret.reasons[reason] += n
+		}
+		ret.recent = append(append([]Violation{}, p.recent...), ret.recent...)
+	}
+	if len(ret.recent) > maxRecentViolations {
+		ret.recent = ret.recent[:maxRecentViolations]
+	}
+	return ret
+}
+
+// Flush sends everything pending as one batch
+func (w *WriteBehindStorage) Flush() {
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+
+	w.lock.Lock()
+	batch := []*pendingIncr{}
+	entries := []*writeBehindEntry{}
+	now := time.Now().Unix()
+	for key, e := range w.local {
+		if e.pending != nil {
+			e.inflight, e.pending = e.pending, nil
+			batch = append(batch, e.inflight)
+			entries = append(entries, e)
+		} else if e.base.expires < now {
+			delete(w.local, key)
+		}
+	}
+	w.pending = 0
+	w.lock.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	results, errs := w.inner.IncrBatch(batch)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var firstErr error
+	failed := 0
+	for i, e := range entries {
+		if errs == nil || errs[i] == nil {
+			e.base, e.inflight = results[i], nil
+			continue
+		}
+		if firstErr == nil {
+			firstErr = errs[i]
+		}
+		failed++
+		// put it back in front of whatever was counted meanwhile, the next flush retries it
+		if e.pending == nil {
+			e.pending = e.inflight
+			w.pending++
+		} else {
+			mergePendingIncr(e.pending, e.inflight)
+		}
+		e.inflight = nil
+	}
+	if failed > 0 && w.OnFlushError != nil {
+		w.OnFlushError(firstErr, failed)
+	}
+}
+
+// mergePendingIncr adds older into newer
+func mergePendingIncr(newer *pendingIncr, older *pendingIncr) {
+	newer.count += older.count
+	for reason, n := range older.reasons {
+		newer.reasons[reason] += n
+	}
+	newer.recent = append(newer.recent, older.recent...)
+	if len(newer.recent) > maxRecentViolations {
+		newer.recent = newer.recent[:maxRecentViolations]
+	}
+	if older.expires.After(newer.expires) {
+		newer.expires = older.expires
+	}
+}
+
+// ResetIpViolations drops anything unflushed for ip and resets it in the backend right away.
+// It waits for a flush in flight, which could otherwise write its increment back after the reset.
+func (w *WriteBehindStorage) ResetIpViolations(ip string) error {
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+	w.lock.Lock()
+	if e, ok := w.local[ip]; ok {
+		if e.pending != nil {
+			w.pending--
+		}
+		delete(w.local, ip)
+	}
+	w.lock.Unlock()
+	return w.inner.ResetIpViolations(ip)
+}
+
+func (w *WriteBehindStorage) AllowRate(key string, interval time.Duration, burst int) (bool, error) {
+	return w.inner.AllowRate(key, interval, burst)
+}
+
+func (w *WriteBehindStorage) TrackDistinct(key string, member string, window time.Duration) (int, error) {
+	return w.inner.TrackDistinct(key, member, window)
+}
+
+func (w *WriteBehindStorage) ResetDistinct(key string) error {
+	return w.inner.ResetDistinct(key)
+}
+
+// Close stops the flusher after one last flush, increments it couldn't write are lost (see OnFlushError)
+func (w *WriteBehindStorage) Close() {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	<-w.closed
+}
@@ -0,0 +1,179 @@
+package teapot_hacker_isolation
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchMemory applies batches to a MemoryStorage, counting flushes and failing on demand
+type batchMemory struct {
+	*MemoryStorage
+	lock    sync.Mutex
+	batches int
+	fail    bool
+	// keys whose increments fail, while the rest of the batch goes through
+	failKeys map[string]bool
+	// if set, batches wait for release, announcing themselves on entered
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *batchMemory) IncrBatch(batch []*pendingIncr) ([]StorageItem, []error) {
+	if b.release != nil {
+		select {
+		case b.entered <- struct{}{}:
+		default:
+		}
+		<-b.release
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.fail {
+		return nil, batchErrors(len(batch), errors.New("unreachable"))
+	}
+	b.batches++
+	ret := make([]StorageItem, len(batch))
+	errs := make([]error, len(batch))
+	for i, p := range batch {
+		if b.failKeys[p.key] {
+			errs[i] = errors.New("WRONGTYPE")
+			continue
+		}
+		for reason, n := range p.reasons {
+			ret[i], _ = b.MemoryStorage.IncrIpViolations(p.key, time.Until(p.expires), Violation{Reason: reason, Weight: n})
+		}
+	}
+	return ret, errs
+}
+
+func TestWriteBehindCountsLocallyAndFlushesInOneBatch(t *testing.T) {
+	inner := &batchMemory{MemoryStorage: NewMemoryStorage()}
+	inner.MemoryStorage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"}) // from another instance
+	storage := NewWriteBehindStorage(inner, time.Hour, 10)
+	defer storage.Close()
+
+	storage.GetIpViolations("1.2.3.4")
+	var found StorageItem
+	for i := 0; i < 3; i++ {
+		found, _ = storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"})
+	}
+	storage.IncrIpViolations("5.6.7.8", time.Minute, Violation{Reason: "rate", Weight: 2})
+	if found.count != 4 || found.reasons["status:418"] != 4 {
+		t.Errorf("expected the local view to be 4, got %d %v", found.count, found.reasons)
+	}
+	if inner.batches != 0 {
+		t.Errorf("expected nothing flushed yet, got %d batches", inner.batches)
+	}
+
+	storage.Flush()
+	if inner.batches != 1 {
+		t.Errorf("expected 1 batch, got %d", inner.batches)
+	}
+	stored, _ := inner.MemoryStorage.GetIpViolations("1.2.3.4")
+	if stored.count != 4 {
+		t.Errorf("expected 4 in the backend, got %d", stored.count)
+	}
+	stored, _ = inner.MemoryStorage.GetIpViolations("5.6.7.8")
+	if stored.count != 2 {
+		t.Errorf("expected 2 in the backend, got %d", stored.count)
+	}
+	found, _ = storage.GetIpViolations("1.2.3.4")
+	if found.count != 4 {
+		t.Errorf("expected 4 after the flush, got %d", found.count)
+	}
+}
+
+func TestWriteBehindRetriesFailedFlushes(t *testing.T) {
+	inner := &batchMemory{MemoryStorage: NewMemoryStorage(), fail: true}
+	storage := NewWriteBehindStorage(inner, time.Hour, 10)
+	defer storage.Close()
+	failed := 0
+	storage.OnFlushError = func(err error, keys int) { failed += keys }
+
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"})
+	storage.Flush()
+	found, _ := storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"})
+	if failed != 1 || found.count != 2 {
+		t.Errorf("expected 1 failed key and a local count of 2, got %d and %d", failed, found.count)
+	}
+
+	inner.fail = false
+	storage.Flush()
+	stored, _ := inner.MemoryStorage.GetIpViolations("1.2.3.4")
+	if stored.count != 2 {
+		t.Errorf("expected the retried flush to write 2, got %d", stored.count)
+	}
+}
+
+func TestWriteBehindOnlyRetriesTheKeysThatFailed(t *testing.T) {
+	inner := &batchMemory{MemoryStorage: NewMemoryStorage(), failKeys: map[string]bool{"5.6.7.8": true}}
+	storage := NewWriteBehindStorage(inner, time.Hour, 10)
+	defer storage.Close()
+	failed := 0
+	storage.OnFlushError = func(err error, keys int) { failed += keys }
+
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"})
+	storage.IncrIpViolations("5.6.7.8", time.Minute, Violation{Reason: "status:418"})
+	storage.Flush()
+	if failed != 1 {
+		t.Errorf("expected 1 failed key, got %d", failed)
+	}
+
+	inner.lock.Lock()
+	inner.failKeys = nil
+	inner.lock.Unlock()
+	storage.Flush()
+	if stored, _ := inner.MemoryStorage.GetIpViolations("1.2.3.4"); stored.count != 1 {
+		t.Errorf("expected the key that went through to be written once, got %d", stored.count)
+	}
+	if stored, _ := inner.MemoryStorage.GetIpViolations("5.6.7.8"); stored.count != 1 {
+		t.Errorf("expected the failed key to be written by the retry, got %d", stored.count)
+	}
+}
+
+func TestWriteBehindWritesThroughWhenFull(t *testing.T) {
+	inner := &batchMemory{MemoryStorage: NewMemoryStorage()}
+	storage := NewWriteBehindStorage(inner, time.Hour, 1)
+	defer storage.Close()
+
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"})
+	storage.IncrIpViolations("5.6.7.8", time.Minute, Violation{Reason: "status:418"})
+	if stored, _ := inner.MemoryStorage.GetIpViolations("1.2.3.4"); stored.count != 0 {
+		t.Errorf("expected the first key to wait for a flush, got %d", stored.count)
+	}
+	if stored, _ := inner.MemoryStorage.GetIpViolations("5.6.7.8"); stored.count != 1 {
+		t.Errorf("expected the second key to be written through, got %d", stored.count)
+	}
+}
+
+func TestWriteBehindResetWaitsForTheFlushInFlight(t *testing.T) {
+	inner := &batchMemory{MemoryStorage: NewMemoryStorage(), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	storage := NewWriteBehindStorage(inner, time.Hour, 10)
+	defer storage.Close()
+
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"})
+	go storage.Flush()
+	<-inner.entered
+	storage.IncrIpViolations("1.2.3.4", time.Minute, Violation{Reason: "status:418"}) // pending behind the flush
+
+	reset := make(chan error, 1)
+	go func() { reset <- storage.ResetIpViolations("1.2.3.4") }()
+	time.Sleep(20 * time.Millisecond)
+	if len(reset) != 0 {
+		t.Error("expected the reset to wait for the flush in flight")
+	}
+	close(inner.release)
+	if err := <-reset; err != nil {
+		t.Fatal(err)
+	}
+
+	storage.Flush()
+	if stored, _ := inner.MemoryStorage.GetIpViolations("1.2.3.4"); stored.count != 0 {
+		t.Errorf("expected nothing in the backend after the reset, got %d", stored.count)
+	}
+	if found, _ := storage.GetIpViolations("1.2.3.4"); found.count != 0 {
+		t.Errorf("expected nothing locally after the reset, got %d", found.count)
+	}
+}
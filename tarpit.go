@@ -0,0 +1,121 @@
+package teapot_hacker_isolation
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tarpit tracks how many connections we're currently holding open, so we can't exhaust our own sockets.
+type Tarpit struct {
+	interval      time.Duration
+	bytesPerTick  int
+	duration      time.Duration
+	maxPerIP      int
+	maxConcurrent int
+	lock          sync.Mutex
+	activePerIP   map[string]int
+	activeTotal   int
+}
+
+func NewTarpit(config *Config) *Tarpit {
+	tp := &Tarpit{
+		interval:      time.Duration(config.TarpitIntervalMs) * time.Millisecond,
+		bytesPerTick:  config.TarpitBytesPerInterval,
+		duration:      time.Duration(config.TarpitDurationSeconds) * time.Second,
+		maxPerIP:      config.TarpitMaxPerIP,
+		maxConcurrent: config.TarpitMaxConcurrent,
+		activePerIP:   make(map[string]int),
+	}
+	if tp.interval <= 0 {
+		tp.interval = time.Second
+	}
+	if tp.bytesPerTick <= 0 {
+		tp.bytesPerTick = 1
+	}
+	return tp
+}
+
+// acquire reserves a slot for ip, false means a cap was hit and the caller should answer normally
+func (tp *Tarpit) acquire(ip string) bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if tp.maxConcurrent > 0 && tp.activeTotal >= tp.maxConcurrent {
+		return false
+	}
+	if tp.maxPerIP > 0 && tp.activePerIP[ip] >= tp.maxPerIP {
+		return false
+	}
+	tp.activeTotal++
+	tp.activePerIP[ip]++
+	return true
+}
+
+func (tp *Tarpit) release(ip string) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.activeTotal--
+	tp.activePerIP[ip]--
+	if tp.activePerIP[ip] <= 0 {
+		delete(tp.activePerIP, ip)
+	}
+}
+
+// Active returns the number of connections currently held open.
+func (tp *Tarpit) Active() int {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.activeTotal
+}
+
+// drip writes body bytesPerTick at a time, padding with spaces until duration is used up,
+// and gives up as soon as the client goes away.
+func (tp *Tarpit) drip(rw http.ResponseWriter, req *http.Request, body []byte) {
+	flusher, _ := rw.(http.Flusher)
+	deadline := time.Now().Add(tp.duration)
+	ticker := time.NewTicker(tp.interval)
+	defer ticker.Stop()
+	padding := bytes.Repeat([]byte(" "), tp.bytesPerTick)
+	for {
+		chunk := padding
+		if len(body) > 0 {
+			n := tp.bytesPerTick
+			if n > len(body) {
+				n = len(body)
+			}
+			chunk, body = body[:n], body[n:]
+		} else if !time.Now().Before(deadline) {
+			return
+		}
+		if _, err := rw.Write(chunk); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(body) == 0 && !time.Now().Before(deadline) {
+			return
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TarpitResponse is the tarpit block action: same status, headers and body as ReturnHackerResponse,
+// just delivered painfully slowly. Falls back to ReturnHackerResponse when the caps are reached.
+func (t *TeapotHackerIsolationPlugin) TarpitResponse(rw http.ResponseWriter, req *http.Request, ip string, policy *Policy, found StorageItem, reason string) {
+	if !t.Tarpit.acquire(ip) {
+		t.Metrics.Inc("teapot_tarpit_requests_total", "overflow")
+		t.ReturnHackerResponse(rw, req, policy, found, reason)
+		return
+	}
+	defer t.Tarpit.release(ip)
+	t.Metrics.Inc("teapot_tarpit_requests_total", "tarpitted")
+	body := t.prepareBlockResponse(rw, req, policy, found, reason)
+	rw.WriteHeader(policy.ReturnStatusCodeOnBlock)
+	t.Tarpit.drip(rw, req, body)
+}
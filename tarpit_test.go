@@ -0,0 +1,52 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTarpitDripsAndRespectsCancellation(t *testing.T) {
+	config := CreateTestConfig()
+	config.BlockAction = "tarpit"
+	config.TarpitIntervalMs = 5
+	config.TarpitBytesPerInterval = 4
+	config.TarpitDurationSeconds = 60
+	config.TarpitMaxPerIP = 1
+	newPlugin, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := StorageItem{count: 2, expires: time.Now().Unix() + 60}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/innocent", nil)
+	req.RemoteAddr = "0.1.2.3:666"
+	done := make(chan struct{})
+	go func() {
+		newPlugin.Block(httptest.NewRecorder(), req, "0.1.2.3", newPlugin.DefaultPolicy, found, "jailed")
+		close(done)
+	}()
+
+	// wait for the first connection to be held, a second one from the same IP is over the cap
+	for i := 0; newPlugin.Tarpit.Active() == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	recorder := httptest.NewRecorder()
+	newPlugin.Block(recorder, req.WithContext(context.Background()), "0.1.2.3", newPlugin.DefaultPolicy, found, "jailed")
+	if recorder.Body.String() != config.ReturnBodyOnBlock || recorder.Code != 418 {
+		t.Errorf("Expected an immediate block response over the cap, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tarpit ignored request cancellation")
+	}
+	if newPlugin.Tarpit.Active() != 0 {
+		t.Errorf("Tarpit slot leaked, %d still active", newPlugin.Tarpit.Active())
+	}
+}
@@ -3,31 +3,111 @@ package teapot_hacker_isolation
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Config the plugin configuration.
 type Config struct {
-	MinInstances               int      `json:"minInstances"`
-	ExpirySeconds              int      `json:"expirySeconds"`
-	ReturnCurrentExpiresHeader string   `json:"returnCurrentExpiresHeader"`
-	ReturnCurrentStatusHeader  string   `json:"returnCurrentStatusHeader"`
-	ReturnCurrentCountHeader   string   `json:"returnCurrentCountHeader"`
-	StorageSystem              string   `json:"storageSystem"`
-	RedisHost                  string   `json:"redisHost"`
-	RedisPort                  int      `json:"redisPort"`
-	LoggingPrefix              string   `json:"loggingPrefix"`
-	TriggerOnHeaders           []string `json:"triggerOnHeaders"`
-	TriggerOnStatusCodes       []int    `json:"triggerOnStatusCodes"`
-	ReturnStatusCodeOnBlock    int      `json:"blockedStatusCode"`
-	ReturnBodyOnBlock          string   `json:"blockedBody"`
-	ReturnHeadersOnBlock       []string `json:"blockedHeaders"`
+	MinInstances               int                   `json:"minInstances"`
+	ExpirySeconds              int                   `json:"expirySeconds"`
+	ReturnCurrentExpiresHeader string                `json:"returnCurrentExpiresHeader"`
+	ReturnCurrentStatusHeader  string                `json:"returnCurrentStatusHeader"`
+	ReturnCurrentCountHeader   string                `json:"returnCurrentCountHeader"`
+	ReturnCurrentExpiresFormat string                `json:"returnCurrentExpiresFormat"`
+	RetryAfterFormat           string                `json:"retryAfterFormat"`
+	ReturnRateLimitHeaders     bool                  `json:"returnRateLimitHeaders"`
+	StorageSystem              string                `json:"storageSystem"`
+	RedisHost                  string                `json:"redisHost"`
+	RedisPort                  int                   `json:"redisPort"`
+	RedisWriteBehindMs         int                   `json:"redisWriteBehindMs"`
+	RedisWriteBehindMaxKeys    int                   `json:"redisWriteBehindMaxKeys"`
+	LoggingPrefix              string                `json:"loggingPrefix"`
+	LogLevel                   string                `json:"logLevel"`
+	LogFormat                  string                `json:"logFormat"`
+	TriggerOnHeaders           []string              `json:"triggerOnHeaders"`
+	TriggerOnStatusCodes       []int                 `json:"triggerOnStatusCodes"`
+	ReturnStatusCodeOnBlock    int                   `json:"blockedStatusCode"`
+	ReturnBodyOnBlock          string                `json:"blockedBody"`
+	ReturnHeadersOnBlock       []string              `json:"blockedHeaders"`
+	MetricsPath                string                `json:"metricsPath"`
+	MetricsToken               string                `json:"metricsToken"`
+	MetricsAllowedNetworks     []string              `json:"metricsAllowedNetworks"`
+	SecurityLogPath            string                `json:"securityLogPath"`
+	SecurityLogFormat          string                `json:"securityLogFormat"`
+	SecurityLogMaxSizeMB       int                   `json:"securityLogMaxSizeMB"`
+	SecurityLogMaxBackups      int                   `json:"securityLogMaxBackups"`
+	Webhooks                   []WebhookConfig       `json:"webhooks"`
+	WebhookQueueSize           int                   `json:"webhookQueueSize"`
+	WebhookEscalationCount     int                   `json:"webhookEscalationCount"`
+	BlockedTemplates           []BlockTemplateConfig `json:"blockedTemplates"`
+	BlockedTemplatesDefaults   bool                  `json:"blockedTemplatesDefaults"`
+	BlockAction                string                `json:"blockAction"`
+	TarpitIntervalMs           int                   `json:"tarpitIntervalMs"`
+	TarpitBytesPerInterval     int                   `json:"tarpitBytesPerInterval"`
+	TarpitDurationSeconds      int                   `json:"tarpitDurationSeconds"`
+	TarpitMaxPerIP             int                   `json:"tarpitMaxPerIP"`
+	TarpitMaxConcurrent        int                   `json:"tarpitMaxConcurrent"`
+	DropWithReset              bool                  `json:"dropWithReset"`
+	RedirectURL                string                `json:"redirectUrl"`
+	RedirectStatusCode         int                   `json:"redirectStatusCode"`
+	RedirectSecret             string                `json:"redirectSecret"`
+	ChallengeThreshold         int                   `json:"challengeThreshold"`
+	ChallengeDifficulty        int                   `json:"challengeDifficulty"`
+	ChallengeSecret            string                `json:"challengeSecret"`
+	ChallengeCookieName        string                `json:"challengeCookieName"`
+	ChallengeCookieTTLSeconds  int                   `json:"challengeCookieTTLSeconds"`
+	ChallengePath              string                `json:"challengePath"`
+	ChallengeResetCount        bool                  `json:"challengeResetCount"`
+	Policies                   []PolicyConfig        `json:"policies"`
+	ReasonThresholds           map[string]int        `json:"reasonThresholds"`
+	ReturnCurrentReasonsHeader string                `json:"returnCurrentReasonsHeader"`
+	AdminPath                  string                `json:"adminPath"`
+	AdminToken                 string                `json:"adminToken"`
+	AdminAllowedNetworks       []string              `json:"adminAllowedNetworks"`
+	IdentityParts              []string              `json:"identityParts"`
+	IdentityIPv4Prefix         int                   `json:"identityIPv4Prefix"`
+	IdentityIPv6Prefix         int                   `json:"identityIPv6Prefix"`
+	JwtClaim                   string                `json:"jwtClaim"`
+	JwtCookieName              string                `json:"jwtCookieName"`
+	JwtHmacSecret              string                `json:"jwtHmacSecret"`
+	JwtPublicKeyFile           string                `json:"jwtPublicKeyFile"`
+	JwtJwksFile                string                `json:"jwtJwksFile"`
+	Fingerprint                bool                  `json:"fingerprint"`
+	FingerprintHeaders         []string              `json:"fingerprintHeaders"`
+	FingerprintTlsHeader       string                `json:"fingerprintTlsHeader"`
+	FingerprintMinInstances    int                   `json:"fingerprintMinInstances"`
+	RateLimitRequests          int                   `json:"rateLimitRequests"`
+	RateLimitPeriodSeconds     int                   `json:"rateLimitPeriodSeconds"`
+	RateLimitBurst             int                   `json:"rateLimitBurst"`
+	RateLimitWeight            int                   `json:"rateLimitWeight"`
+	BurstStatusCodes           []int                 `json:"burstStatusCodes"`
+	BurstDistinctPaths         int                   `json:"burstDistinctPaths"`
+	BurstWindowSeconds         int                   `json:"burstWindowSeconds"`
+	BurstWeight                int                   `json:"burstWeight"`
+	AuthPaths                  []string              `json:"authPaths"`
+	AuthFailureStatusCodes     []int                 `json:"authFailureStatusCodes"`
+	AuthFailureHeader          string                `json:"authFailureHeader"`
+	AuthUsernameFields         []string              `json:"authUsernameFields"`
+	AuthMaxFailuresPerIP       int                   `json:"authMaxFailuresPerIP"`
+	AuthMaxFailuresPerUsername int                   `json:"authMaxFailuresPerUsername"`
+	AuthClearOnSuccess         bool                  `json:"authClearOnSuccess"`
+	SignatureCategories        []string              `json:"signatureCategories"`
+	SignatureScores            map[string]int        `json:"signatureScores"`
+	SignatureDisabledIds       []string              `json:"signatureDisabledIds"`
+	Rules                      []RuleConfig          `json:"rules"`
+	TriggerOnLatencyMs         int                   `json:"triggerOnLatencyMs"`
+	TriggerOnResponseBytes     int                   `json:"triggerOnResponseBytes"`
+	StoragePath                string                `json:"storagePath"`
+	MemorySnapshotPath         string                `json:"memorySnapshotPath"`
+	SnapshotIntervalSeconds    int                   `json:"memorySnapshotIntervalSeconds"`
+	SqlDriver                  string                `json:"sqlDriver"`
+	SqlDsn                     string                `json:"sqlDsn"`
+	SqlHistoryRetentionDays    int                   `json:"sqlHistoryRetentionDays"`
 }
 
 // CreateConfig creates the DEFAULT plugin configuration - no access to config yet!
@@ -38,22 +118,119 @@ func CreateConfig() *Config {
 		ReturnCurrentExpiresHeader: "",
 		ReturnCurrentStatusHeader:  "",
 		ReturnCurrentCountHeader:   "",
+		ReturnCurrentExpiresFormat: "rfc3339",
+		RetryAfterFormat:           "seconds",
+		ReturnRateLimitHeaders:     false,
 		StorageSystem:              "Memory",
+		RedisWriteBehindMs:         0,
+		RedisWriteBehindMaxKeys:    10000,
 		LoggingPrefix:              "TeapotIsolation: ",
+		LogLevel:                   "info",
+		LogFormat:                  "text",
 		TriggerOnHeaders:           []string{"X-Hacker-Detected"},
 		TriggerOnStatusCodes:       []int{418, 405},
 		ReturnStatusCodeOnBlock:    418,
 		ReturnBodyOnBlock:          "This is a coffee shop!",
 		ReturnHeadersOnBlock:       []string{"Content-Type: tea/earl-grey"},
+		MetricsPath:                "",
+		MetricsToken:               "",
+		MetricsAllowedNetworks:     []string{},
+		SecurityLogPath:            "",
+		SecurityLogFormat:          "fail2ban",
+		SecurityLogMaxSizeMB:       10,
+		SecurityLogMaxBackups:      3,
+		Webhooks:                   []WebhookConfig{},
+		WebhookQueueSize:           100,
+		WebhookEscalationCount:     0,
+		BlockedTemplates:           []BlockTemplateConfig{},
+		BlockedTemplatesDefaults:   false,
+		BlockAction:                "respond",
+		TarpitIntervalMs:           1000,
+		TarpitBytesPerInterval:     1,
+		TarpitDurationSeconds:      30,
+		TarpitMaxPerIP:             2,
+		TarpitMaxConcurrent:        100,
+		DropWithReset:              false,
+		RedirectURL:                "",
+		RedirectStatusCode:         302,
+		RedirectSecret:             "",
+		ChallengeThreshold:         0,
+		ChallengeDifficulty:        16,
+		ChallengeSecret:            "",
+		ChallengeCookieName:        "teapot_pass",
+		ChallengeCookieTTLSeconds:  3600,
+		ChallengePath:              "/.teapot/challenge",
+		ChallengeResetCount:        true,
+		Policies:                   []PolicyConfig{},
+		ReasonThresholds:           map[string]int{},
+		ReturnCurrentReasonsHeader: "",
+		AdminPath:                  "",
+		AdminToken:                 "",
+		AdminAllowedNetworks:       []string{},
+		IdentityParts:              []string{"ip"},
+		IdentityIPv4Prefix:         24,
+		IdentityIPv6Prefix:         64,
+		JwtClaim:                   "sub",
+		JwtCookieName:              "",
+		JwtHmacSecret:              "",
+		JwtPublicKeyFile:           "",
+		JwtJwksFile:                "",
+		Fingerprint:                false,
+		FingerprintHeaders:         []string{"Accept", "Accept-Encoding", "Accept-Language", "User-Agent"},
+		FingerprintTlsHeader:       "",
+		FingerprintMinInstances:    50,
+		RateLimitRequests:          0,
+		RateLimitPeriodSeconds:     1,
+		RateLimitBurst:             0,
+		RateLimitWeight:            1,
+		BurstStatusCodes:           []int{404, 403, 401},
+		BurstDistinctPaths:         0,
+		BurstWindowSeconds:         60,
+		BurstWeight:                5,
+		AuthPaths:                  []string{},
+		AuthFailureStatusCodes:     []int{401},
+		AuthFailureHeader:          "",
+		AuthUsernameFields:         []string{"username", "user", "email", "login"},
+		AuthMaxFailuresPerIP:       10,
+		AuthMaxFailuresPerUsername: 5,
+		AuthClearOnSuccess:         false,
+		SignatureCategories:        []string{},
+		SignatureScores:            map[string]int{},
+		SignatureDisabledIds:       []string{},
+		Rules:                      []RuleConfig{},
+		TriggerOnLatencyMs:         0,
+		TriggerOnResponseBytes:     0,
+		StoragePath:                "",
+		MemorySnapshotPath:         "",
+		SnapshotIntervalSeconds:    60,
+		SqlDriver:                  "",
+		SqlDsn:                     "",
+		SqlHistoryRetentionDays:    0,
 	}
 }
 
 type TeapotHackerIsolationPlugin struct {
-	Config  *Config
-	Logger  *log.Logger
-	Storage IStorage
-	name    string
-	next    http.Handler
+	Config        *Config
+	DefaultPolicy *Policy
+	Policies      []*Policy
+	Identity      *IdentityBuilder
+	Fingerprint   *Fingerprinter
+	Auth          *AuthTracker
+	Signatures    *SignaturePack
+	Rules         []*Rule
+	Logger        *MyTraefikLogger
+	SecurityLog   *SecurityLog
+	Webhooks      *WebhookNotifier
+	Responder     *BlockResponder
+	Tarpit        *Tarpit
+	Redirect      *BlockRedirect
+	Challenge     *Challenge
+	Admin         *AdminAccess
+	MetricsAccess *AdminAccess
+	Storage       IStorage
+	Metrics       *Metrics
+	name          string
+	next          http.Handler
 }
 
 // for debugging and to get back a strongly typed plugin implementation
@@ -62,25 +239,197 @@ func NewTeapotHackerIsolationPlugin(ctx context.Context, next http.Handler, conf
 		return nil, fmt.Errorf("config can not be nil")
 	}
 
-	logger := log.New(os.Stderr, config.LoggingPrefix, log.LstdFlags|log.Lshortfile)
+	logger, err := NewMyTraefikLoggerFromConfig(config, name)
+	if err != nil {
+		return nil, err
+	}
 
 	plugin := &TeapotHackerIsolationPlugin{
-		Config: config,
-		Logger: logger,
-		next:   next,
-		name:   name,
+		Config:        config,
+		DefaultPolicy: NewDefaultPolicy(config),
+		Logger:        logger,
+		Metrics:       NewMetrics(name),
+		next:          next,
+		name:          name,
+	}
+	plugin.Identity, err = NewIdentityBuilder(config)
+	if err != nil {
+		return nil, err
+	}
+	plugin.Fingerprint, err = NewFingerprinter(config)
+	if err != nil {
+		return nil, err
+	}
+	plugin.Admin, err = NewAdminAccess(config)
+	if err != nil {
+		return nil, err
+	}
+	plugin.MetricsAccess, err = NewMetricsAccess(config)
+	if err != nil {
+		return nil, err
+	}
+	plugin.Auth = NewAuthTracker(config, plugin.DefaultPolicy)
+	for _, pc := range config.Policies {
+		policy, err := NewPolicy(pc, plugin.DefaultPolicy)
+		if err != nil {
+			return nil, err
+		}
+		plugin.Policies = append(plugin.Policies, policy)
+	}
+
+	if config.SecurityLogPath != "" {
+		plugin.SecurityLog, err = NewSecurityLog(config)
+		if err != nil {
+			return nil, err
+		}
+		plugin.SecurityLog.OnRotateError = func(err error) {
+			logger.Errorw("unable to rotate the security log, still writing to the current file", LogFields{"path": config.SecurityLogPath, "error": err})
+		}
+		go func() {
+			<-ctx.Done()
+			plugin.SecurityLog.Close()
+		}()
+	}
+	plugin.Responder, err = NewBlockResponder(config)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(config.BlockAction) {
+	case "", "respond":
+	case "tarpit":
+		plugin.Tarpit = NewTarpit(config)
+		plugin.Metrics.RegisterCounter("teapot_tarpit_requests_total", "Block responses sent through the tarpit, by result (tarpitted, overflow).", "result")
+	case "redirect":
+		plugin.Redirect, err = NewBlockRedirect(config)
+		if err != nil {
+			return nil, err
+		}
+	case "drop":
+		plugin.Metrics.RegisterCounter("teapot_dropped_connections_total", "Blocked connections dropped, by result (closed, abort, fallback).", "result")
+	default:
+		return nil, fmt.Errorf("block action %s unknown", config.BlockAction)
+	}
+	for _, rc := range config.Rules {
+		rule, err := CompileRule(rc)
+		if err != nil {
+			return nil, err
+		}
+		plugin.Rules = append(plugin.Rules, rule)
+	}
+	plugin.Signatures, err = NewSignaturePack(config)
+	if err != nil {
+		return nil, err
+	}
+	if plugin.Signatures != nil {
+		plugin.Metrics.RegisterCounter("teapot_signature_matches_total", "Requests matching a bundled signature, by category.", "category")
+	}
+	if config.ChallengeThreshold > 0 {
+		plugin.Challenge, err = NewChallenge(config)
+		if err != nil {
+			return nil, err
+		}
+		plugin.Metrics.RegisterCounter("teapot_challenges_total", "Proof-of-work challenges, by result (issued, solved, failed).", "result")
+	}
+	if len(config.Webhooks) > 0 {
+		plugin.Webhooks, err = NewWebhookNotifier(config, logger, plugin.Metrics)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			plugin.Webhooks.Close()
+		}()
 	}
 
 	//var storage IStorage
-	var err error
 	storageType := strings.ToLower(config.StorageSystem)
+	// unbans can only be noticed when the entries live in this process
+	onExpire := func(key string, item StorageItem) {
+		policyName, identity := splitPolicyKey(key)
+		if plugin.isBanned(plugin.policyByName(policyName), identity, item) {
+			event := WebhookEvent{Event: "unban", Policy: policyName, Count: item.count, Expires: item.expires, Time: time.Now(), Middleware: name}
+			fields := LogFields{"policy": policyName, "action": "unban", "count": item.count}
+			if plugin.Identity.IsIpOnly() {
+				event.IP, fields["ip"] = identity, identity
+			} else {
+				event.Identity, fields["identity"] = identity, identity
+			}
+			plugin.Metrics.Inc("teapot_unbans_total", "")
+			plugin.Logger.Infow("ban expired", fields)
+			plugin.Webhooks.Notify(event)
+		}
+	}
 	switch storageType {
 	case "memory":
-		plugin.Storage = NewMemoryStorage()
+		if config.MemorySnapshotPath == "" {
+			memory := NewMemoryStorage()
+			memory.OnExpire = onExpire
+			plugin.Storage = memory
+			break
+		}
+		interval := time.Duration(config.SnapshotIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		snapshots, err := NewSnapshotStorage(config, interval, onExpire, func(err error) {
+			logger.Errorw("unable to save memory snapshot", LogFields{"path": config.MemorySnapshotPath, "error": err})
+		})
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			if err := snapshots.Close(); err != nil {
+				logger.Errorw("unable to save memory snapshot", LogFields{"path": config.MemorySnapshotPath, "error": err})
+			}
+		}()
+		plugin.Storage = snapshots
+	case "file":
+		file, err := NewFileStorage(config, onExpire, func(err error) {
+			plugin.Metrics.Inc("teapot_storage_errors_total", "compact")
+			logger.Errorw("unable to compact the storage log, keeping the old one", LogFields{"path": config.StoragePath, "error": err})
+		})
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			file.Close()
+		}()
+		plugin.Storage = file
+	case "sql":
+		sqlStorage, err := NewSqlStorage(config, func(operation string, err error, rows int) {
+			if rows > 0 {
+				plugin.Metrics.Add("teapot_storage_errors_total", operation, uint64(rows))
+			} else {
+				plugin.Metrics.Inc("teapot_storage_errors_total", operation)
+			}
+			logger.Errorw("sql storage failed in the background", LogFields{"operation": operation, "rows": rows, "error": err})
+		})
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			sqlStorage.Close()
+		}()
+		plugin.Storage = sqlStorage
 	case "redis":
 		redis, err := NewRedisStorage(config)
 		if err == nil && redis != nil {
 			plugin.Storage = redis
+			if config.RedisWriteBehindMs > 0 {
+				writeBehind := NewWriteBehindStorage(redis, time.Duration(config.RedisWriteBehindMs)*time.Millisecond, config.RedisWriteBehindMaxKeys)
+				writeBehind.OnFlushError = func(err error, keys int) {
+					plugin.Metrics.Inc("teapot_storage_errors_total", "flush")
+					logger.Errorw("unable to flush violations to redis, retrying with the next flush", LogFields{"keys": keys, "error": err})
+				}
+				go func() {
+					<-ctx.Done()
+					writeBehind.Close()
+				}()
+				plugin.Storage = writeBehind
+			}
 		}
 	default:
 		panic(fmt.Sprintf("Storage type %s unknown", config.StorageSystem))
@@ -94,14 +443,28 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	return NewTeapotHackerIsolationPlugin(ctx, next, config, name)
 }
 
-func (t *TeapotHackerIsolationPlugin) AppendStatusHeaders(rw http.ResponseWriter, found StorageItem, blocked bool) {
+func (t *TeapotHackerIsolationPlugin) AppendStatusHeaders(rw http.ResponseWriter, policy *Policy, found StorageItem, blocked bool) {
+	expiresAt := time.Unix(found.expires, 0)
+	secondsLeft := found.expires - time.Now().Unix()
+	if secondsLeft < 0 || found.count == 0 {
+		secondsLeft = 0
+	}
 	if blocked {
 		if t.Config.ReturnCurrentStatusHeader != "" {
 			rw.Header().Set(t.Config.ReturnCurrentStatusHeader, "BLOCKED")
 		}
 		if t.Config.ReturnCurrentExpiresHeader != "" {
-			expiresAt := time.Unix(found.expires, 0)
-			rw.Header().Set(t.Config.ReturnCurrentExpiresHeader, expiresAt.String())
+			if strings.EqualFold(t.Config.ReturnCurrentExpiresFormat, "unix") {
+				rw.Header().Set(t.Config.ReturnCurrentExpiresHeader, strconv.FormatInt(found.expires, 10))
+			} else {
+				rw.Header().Set(t.Config.ReturnCurrentExpiresHeader, expiresAt.UTC().Format(time.RFC3339))
+			}
+		}
+		switch strings.ToLower(t.Config.RetryAfterFormat) {
+		case "seconds":
+			rw.Header().Set("Retry-After", strconv.FormatInt(secondsLeft, 10))
+		case "http-date":
+			rw.Header().Set("Retry-After", expiresAt.UTC().Format(http.TimeFormat))
 		}
 	} else {
 		if t.Config.ReturnCurrentStatusHeader != "" {
@@ -111,54 +474,203 @@ func (t *TeapotHackerIsolationPlugin) AppendStatusHeaders(rw http.ResponseWriter
 	if t.Config.ReturnCurrentCountHeader != "" {
 		rw.Header().Set(t.Config.ReturnCurrentCountHeader, fmt.Sprintf("%d", found.count))
 	}
+	if t.Config.ReturnCurrentReasonsHeader != "" && len(found.reasons) > 0 {
+		rw.Header().Set(t.Config.ReturnCurrentReasonsHeader, formatReasons(found.reasons))
+	}
+	if t.Config.ReturnRateLimitHeaders {
+		// draft-ietf-httpapi-ratelimit-headers: quota is the violation threshold over the jail window
+		remaining := policy.MinInstances - found.count
+		if remaining < 0 {
+			remaining = 0
+		}
+		rw.Header().Set("RateLimit-Policy", fmt.Sprintf("\"teapot\";q=%d;w=%d", policy.MinInstances, int64(policy.JailTime().Seconds())))
+		rw.Header().Set("RateLimit", fmt.Sprintf("\"teapot\";r=%d;t=%d", remaining, secondsLeft))
+	}
 }
-func (t *TeapotHackerIsolationPlugin) ReturnHackerResponse(rw http.ResponseWriter, found StorageItem) {
-	t.AppendStatusHeaders(rw, found, true)
-	for _, v := range t.Config.ReturnHeadersOnBlock {
+
+// Block answers a jailed client using the configured blockAction.
+func (t *TeapotHackerIsolationPlugin) Block(rw http.ResponseWriter, req *http.Request, ip string, policy *Policy, found StorageItem, reason string) {
+	switch strings.ToLower(t.Config.BlockAction) {
+	case "tarpit":
+		t.TarpitResponse(rw, req, ip, policy, found, reason)
+	case "drop":
+		t.DropConnection(rw, req, policy, found, reason)
+	case "redirect":
+		t.RedirectResponse(rw, req, ip, policy, found, reason)
+	default:
+		t.ReturnHackerResponse(rw, req, policy, found, reason)
+	}
+}
+
+func (t *TeapotHackerIsolationPlugin) ReturnHackerResponse(rw http.ResponseWriter, req *http.Request, policy *Policy, found StorageItem, reason string) {
+	body := t.prepareBlockResponse(rw, req, policy, found, reason)
+	rw.WriteHeader(policy.ReturnStatusCodeOnBlock)
+	if len(body) > 0 {
+		rw.Write(body)
+	}
+}
+
+// prepareBlockResponse sets the block headers and returns the body to send
+func (t *TeapotHackerIsolationPlugin) prepareBlockResponse(rw http.ResponseWriter, req *http.Request, policy *Policy, found StorageItem, reason string) []byte {
+	t.AppendStatusHeaders(rw, policy, found, true)
+	for _, v := range policy.ReturnHeadersOnBlock {
 		if strings.Contains(v, ":") {
 			parts := strings.SplitN(v, ":", 2)
-			rw.Header().Set(parts[0], parts[1])
+			rw.Header().Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
 		}
 	}
-	rw.WriteHeader(t.Config.ReturnStatusCodeOnBlock)
-	if t.Config.ReturnBodyOnBlock != "" {
-		rw.Write([]byte(t.Config.ReturnBodyOnBlock))
+	body := []byte(policy.ReturnBodyOnBlock)
+	if t.Responder != nil {
+		contentType, rendered, err := t.Responder.Render(req.Header.Get("Accept"), t.blockTemplateData(req, policy, found, reason))
+		if err != nil {
+			t.Logger.Errorw("unable to render block template", LogFields{"error": err, "path": req.URL.Path})
+		} else {
+			rw.Header().Set("Content-Type", contentType)
+			body = rendered
+		}
+	}
+	return body
+}
+
+func (t *TeapotHackerIsolationPlugin) blockTemplateData(req *http.Request, policy *Policy, found StorageItem, reason string) BlockTemplateData {
+	return BlockTemplateData{
+		IP:          clientIP(req),
+		Count:       found.count,
+		Expires:     time.Unix(found.expires, 0),
+		ExpiresUnix: found.expires,
+		Reason:      reason,
+		RequestID:   RequestID(req),
+		Status:      policy.ReturnStatusCodeOnBlock,
+		StatusText:  http.StatusText(policy.ReturnStatusCodeOnBlock),
+		Policy:      policy.Name,
+		Method:      req.Method,
+		Host:        req.Host,
+		Path:        req.URL.Path,
 	}
 }
 
 func (t *TeapotHackerIsolationPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	jailTime := time.Duration(t.Config.ExpirySeconds) * time.Minute
+	if t.Config.MetricsPath != "" && req.URL.Path == t.Config.MetricsPath {
+		if status := t.MetricsAccess.Allow(req); status != 0 {
+			refuse(rw, status, "teapot-metrics")
+			return
+		}
+		t.Metrics.ServeHTTP(rw, req)
+		return
+	}
+	if t.Config.AdminPath != "" && req.URL.Path == t.Config.AdminPath {
+		t.ServeAdmin(rw, req)
+		return
+	}
+	t.Metrics.Inc("teapot_requests_total", "")
+	if t.Redirect.IsTarget(req) {
+		t.next.ServeHTTP(rw, req) // never block the appeal page, or blocked users would loop
+		return
+	}
 
-	ip, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		ip = req.RemoteAddr // this shouldn't happen??
+	ip := clientIP(req)
+	// the keys violations are counted against: just the ip unless identityParts says otherwise, plus the fingerprint if enabled
+	identities := t.identities(req, ip)
+	identity := identities[0]
+
+	// every matching policy has its own counter, any one of them can block
+	policies := t.matchPolicies(req)
+	foundByPolicy := make([]StorageItem, len(policies))
+	for i, policy := range policies {
+		for j, id := range identities {
+			found, err := t.getIpViolations(policy.Key(id))
+			if err != nil {
+				t.Logger.Errorw("failed to get IP from storage", t.logFields(req, id, LogFields{"policy": policy.Name, "error": err}))
+				continue
+			}
+			if t.isBanned(policy, id, found) {
+				// increment their badness
+				found, _ = t.incrIpViolations(policy.Key(id), policy.JailTime(), Violation{Reason: "jailed", Path: req.URL.Path, Time: time.Now()})
+				t.Logger.Infow("request blocked", t.logFields(req, id, LogFields{
+					"policy": policy.Name, "action": "block", "reason": "jailed", "count": found.count, "expires": found.expires, "reasons": found.reasons,
+				}))
+				t.Metrics.Inc("teapot_blocked_requests_total", "")
+				if t.Config.WebhookEscalationCount > 0 && found.count == t.Config.WebhookEscalationCount {
+					t.notifyWebhooks(req, id, policy, "escalation", "jailed", found)
+				}
+				t.Block(rw, req, ip, policy, found, "jailed")
+				return // DO NOT CONTINUE
+			}
+			if j == 0 {
+				foundByPolicy[i] = found
+			}
+		}
 	}
-	found := t.Storage.GetIpViolations(ip)
-	if err != nil {
-		t.Logger.Printf("Failed to get IP from storage: %s\n", err.Error())
-	} else if found.count >= t.Config.MinInstances {
-		found = t.Storage.IncrIpViolations(ip, jailTime) // increment their badness
-		expiresAt := time.Unix(found.expires, 0)
-		t.Logger.Printf("IP %s is blocked until %s\n", ip, expiresAt.String())
-		t.ReturnHackerResponse(rw, found)
+	// status headers and the challenge follow the first (most specific) policy
+	if t.Challenge != nil && t.handleChallenge(rw, req, ip, identities, policies[0], foundByPolicy[0]) {
+		return
+	}
+
+	// login endpoints are counted in their own dimensions: per ip and per submitted username
+	authUser := ""
+	if t.Auth != nil && t.Auth.Matches(req) {
+		authUser = t.Auth.Username(req)
+		if t.checkAuthBan(rw, req, ip, authUser) {
+			return // DO NOT CONTINUE
+		}
+	}
+
+	if t.Signatures != nil {
+		if rule, score := t.Signatures.Match(req); rule != nil {
+			t.Metrics.Inc("teapot_signature_matches_total", rule.Category)
+			t.Logger.Infow("signature matched", t.logFields(req, identity, LogFields{"signature": rule.ID, "category": rule.Category, "description": rule.Description, "signaturePack": SignaturePackVersion}))
+			// scored 0: log only
+			if score > 0 && t.countViolationAll(rw, req, ip, identities, policies, foundByPolicy, Violation{Reason: "signature:" + rule.ID, Path: req.URL.Path, Time: time.Now(), Weight: score}) {
+				return // DO NOT CONTINUE
+			}
+		}
+	}
+
+	if len(t.Rules) > 0 && t.countRules(rw, req, ip, identities, policies, foundByPolicy, &exprContext{req: req, ip: ip}) {
 		return // DO NOT CONTINUE
 	}
 
+	if t.Config.RateLimitRequests > 0 && !t.allowRate(req, identity) {
+		// sustained excess feeds the same jail as bad responses
+		if t.countViolationAll(rw, req, ip, identities, policies, foundByPolicy, Violation{Reason: "rate", Path: req.URL.Path, Time: time.Now(), Weight: t.Config.RateLimitWeight}) {
+			return // DO NOT CONTINUE
+		}
+	}
+
 	rw2 := httptest.NewRecorder()
+	started := time.Now()
 	t.next.ServeHTTP(rw2, req)
+	latency := time.Since(started)
 
-	badDetected := t.DetectIfHacker(rw2.Result())
-	if badDetected {
-		found = t.Storage.IncrIpViolations(ip, jailTime)
-		if err != nil {
-			t.Logger.Printf("Unable to log bad IP to storage: %s\n", err.Error())
+	if t.Auth != nil && t.Auth.Matches(req) && t.trackAuthResult(rw, req, ip, authUser, rw2.Result()) {
+		return // DO NOT CONTINUE
+	}
+	if t.Config.BurstDistinctPaths > 0 && t.detectBurst(req, identity, rw2.Code) {
+		// one scanner-sized violation for the whole burst
+		if t.countViolationAll(rw, req, ip, identities, policies, foundByPolicy, Violation{Reason: "burst:" + strconv.Itoa(rw2.Code), Path: req.URL.Path, Time: time.Now(), Weight: t.Config.BurstWeight}) {
+			return // DO NOT CONTINUE
 		}
-		if found.count >= t.Config.MinInstances {
-			expiresAt := time.Unix(found.expires, 0)
-			t.Logger.Printf("IP %s is now blocked until %s\n", ip, expiresAt.String())
-			t.ReturnHackerResponse(rw, found)
+	}
+
+	for i, policy := range policies {
+		trigger := policy.DetectTrigger(rw2.Result())
+		if trigger == "" {
+			trigger = policy.DetectCost(latency, rw2.Body.Len())
+		}
+		if trigger == "" {
+			continue
+		}
+		found, blocked := t.countViolation(rw, req, ip, identities, policy, Violation{Reason: trigger, Path: req.URL.Path, Time: time.Now()})
+		if blocked {
 			return // DO NOT CONTINUE
 		}
+		if found.count > 0 {
+			foundByPolicy[i] = found
+		}
+	}
+
+	if len(t.Rules) > 0 && t.countRules(rw, req, ip, identities, policies, foundByPolicy, &exprContext{req: req, ip: ip, resp: rw2.Result(), latency: latency, size: rw2.Body.Len()}) {
+		return // DO NOT CONTINUE
 	}
 
 	// ok to pass through content
@@ -167,7 +679,7 @@ func (t *TeapotHackerIsolationPlugin) ServeHTTP(rw http.ResponseWriter, req *htt
 			rw.Header().Add(h, v)
 		}
 	}
-	t.AppendStatusHeaders(rw, found, false)
+	t.AppendStatusHeaders(rw, policies[0], foundByPolicy[0], false)
 	// now write status code, after which we can only write body, no more headers!
 	rw.WriteHeader(rw2.Result().StatusCode)
 	if rw2.Body.Len() > 0 {
@@ -175,22 +687,232 @@ func (t *TeapotHackerIsolationPlugin) ServeHTTP(rw http.ResponseWriter, req *htt
 	}
 }
 
-func (t *TeapotHackerIsolationPlugin) DetectIfHacker(rw2 *http.Response) bool {
-	blocked := false
-	for _, v := range t.Config.TriggerOnStatusCodes {
-		if rw2.StatusCode == v {
+// countViolationAll counts violation under every matching policy, returns true if the client was blocked
+func (t *TeapotHackerIsolationPlugin) countViolationAll(rw http.ResponseWriter, req *http.Request, ip string, identities []string, policies []*Policy, foundByPolicy []StorageItem, violation Violation) bool {
+	for i, policy := range policies {
+		found, blocked := t.countViolation(rw, req, ip, identities, policy, violation)
+		if blocked {
 			return true
 		}
+		if found.count > 0 {
+			foundByPolicy[i] = found
+		}
 	}
-	if !blocked {
-		// check headers
-		for name := range rw2.Header {
-			for _, detect := range t.Config.TriggerOnHeaders {
-				if strings.EqualFold(name, detect) {
-					return true
-				}
-			}
+	return false
+}
+
+// countRules counts every matching rule for this phase (pre-request if ctx has no response), returns true if the client was blocked
+func (t *TeapotHackerIsolationPlugin) countRules(rw http.ResponseWriter, req *http.Request, ip string, identities []string, policies []*Policy, foundByPolicy []StorageItem, ctx *exprContext) bool {
+	for _, rule := range t.Rules {
+		if rule.PostResponse != (ctx.resp != nil) || !rule.Matches(ctx) {
+			continue
+		}
+		if t.countViolationAll(rw, req, ip, identities, policies, foundByPolicy, Violation{Reason: "rule:" + rule.Name, Path: req.URL.Path, Time: time.Now(), Weight: rule.Weight}) {
+			return true
 		}
 	}
 	return false
 }
+
+// countViolation counts violation against every identity under policy, and bans on whichever crossed its threshold.
+// Returns the item for the primary identity, and true if the client was blocked (the response is already written).
+func (t *TeapotHackerIsolationPlugin) countViolation(rw http.ResponseWriter, req *http.Request, ip string, identities []string, policy *Policy, violation Violation) (StorageItem, bool) {
+	t.Metrics.Inc("teapot_violations_total", reasonKind(violation.Reason))
+	var primary StorageItem
+	bannedId := ""
+	var bannedFound StorageItem
+	for j, id := range identities {
+		found, err := t.incrIpViolations(policy.Key(id), policy.JailTime(), violation)
+		if err != nil {
+			t.Logger.Errorw("unable to log bad IP to storage", t.logFields(req, id, LogFields{"policy": policy.Name, "error": err}))
+			continue
+		}
+		t.Logger.Debugw("violation counted", t.logFields(req, id, LogFields{
+			"policy": policy.Name, "action": "violation", "reason": violation.Reason, "count": found.count, "expires": found.expires,
+		}))
+		if j == 0 {
+			primary = found
+			t.writeSecurityEvent(req, id, "violation", violation.Reason, found)
+		}
+		if bannedId == "" && t.isBanned(policy, id, found) {
+			bannedId, bannedFound = id, found
+		}
+	}
+	if bannedId == "" {
+		return primary, false
+	}
+	t.Logger.Warnw("IP is now blocked", t.logFields(req, bannedId, LogFields{
+		"policy": policy.Name, "action": "ban", "reason": violation.Reason, "count": bannedFound.count, "expires": bannedFound.expires, "reasons": bannedFound.reasons,
+	}))
+	t.Metrics.Inc("teapot_bans_total", "")
+	t.recordBan(req, policy.Key(bannedId), violation.Reason, bannedFound)
+	t.writeSecurityEvent(req, bannedId, "ban", violation.Reason, bannedFound)
+	t.notifyWebhooks(req, bannedId, policy, "ban", violation.Reason, bannedFound)
+	t.Metrics.Inc("teapot_blocked_requests_total", "")
+	t.Block(rw, req, ip, policy, bannedFound, violation.Reason)
+	return primary, true
+}
+
+// allowRate is false once identity exceeds rateLimitRequests per rateLimitPeriodSeconds (plus rateLimitBurst),
+// storage errors fail open
+func (t *TeapotHackerIsolationPlugin) allowRate(req *http.Request, identity string) bool {
+	period := time.Duration(t.Config.RateLimitPeriodSeconds) * time.Second
+	if period <= 0 {
+		period = time.Second
+	}
+	burst := t.Config.RateLimitBurst
+	if burst <= 0 {
+		burst = t.Config.RateLimitRequests
+	}
+	allowed, err := t.Storage.AllowRate(identity, period/time.Duration(t.Config.RateLimitRequests), burst)
+	if err != nil {
+		t.Metrics.Inc("teapot_storage_errors_total", "rate")
+		t.Logger.Errorw("unable to check request rate", t.logFields(req, identity, LogFields{"error": err}))
+		return true
+	}
+	return allowed
+}
+
+// detectBurst is true once identity has had burstStatusCodes responses on burstDistinctPaths different paths
+// within burstWindowSeconds, the tracking starts over afterwards
+func (t *TeapotHackerIsolationPlugin) detectBurst(req *http.Request, identity string, status int) bool {
+	matched := false
+	for _, code := range t.Config.BurstStatusCodes {
+		if code == status {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	count, err := t.Storage.TrackDistinct(identity, req.URL.Path, time.Duration(t.Config.BurstWindowSeconds)*time.Second)
+	if err != nil {
+		t.Metrics.Inc("teapot_storage_errors_total", "distinct")
+		t.Logger.Errorw("unable to track distinct paths", t.logFields(req, identity, LogFields{"error": err}))
+		return false
+	}
+	if count < t.Config.BurstDistinctPaths {
+		return false
+	}
+	if err := t.Storage.ResetDistinct(identity); err != nil {
+		t.Metrics.Inc("teapot_storage_errors_total", "reset")
+	}
+	return true
+}
+
+// recordBan keeps the ban in the storage's history, if it has one
+func (t *TeapotHackerIsolationPlugin) recordBan(req *http.Request, key string, reason string, found StorageItem) {
+	if recorder, ok := t.Storage.(IBanRecorder); ok {
+		recorder.RecordBan(key, reason, req.URL.Path, found)
+	}
+}
+
+func (t *TeapotHackerIsolationPlugin) identities(req *http.Request, ip string) []string {
+	identities := []string{t.Identity.Key(req, ip)}
+	if t.Fingerprint != nil {
+		identities = append(identities, t.Fingerprint.Key(req))
+	}
+	return identities
+}
+
+func (t *TeapotHackerIsolationPlugin) isBanned(policy *Policy, identity string, found StorageItem) bool {
+	if t.Fingerprint != nil && isFingerprintKey(identity) {
+		return t.Fingerprint.IsBanned(found)
+	}
+	return policy.IsBanned(found)
+}
+
+func clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr // this shouldn't happen??
+	}
+	return ip
+}
+
+// logFields returns the common request fields merged with extra, identity is only logged if it isn't just the ip
+func (t *TeapotHackerIsolationPlugin) logFields(req *http.Request, identity string, extra LogFields) LogFields {
+	ip := clientIP(req)
+	fields := LogFields{
+		"ip":     ip,
+		"path":   req.URL.Path,
+		"method": req.Method,
+	}
+	if identity != ip {
+		fields["identity"] = identity
+	}
+	for k, v := range extra {
+		fields[k] = v
+	}
+	return fields
+}
+
+func (t *TeapotHackerIsolationPlugin) writeSecurityEvent(req *http.Request, identity string, eventType string, reason string, found StorageItem) {
+	err := t.SecurityLog.Write(SecurityEvent{
+		Time:       time.Now(),
+		Type:       eventType,
+		IP:         clientIP(req),
+		Reason:     reason,
+		Count:      found.count,
+		Expires:    found.expires,
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		Middleware: t.name,
+	})
+	if err != nil {
+		t.Logger.Errorw("unable to write security event", t.logFields(req, identity, LogFields{"error": err}))
+	}
+}
+
+func (t *TeapotHackerIsolationPlugin) notifyWebhooks(req *http.Request, identity string, policy *Policy, event string, reason string, found StorageItem) {
+	ip := clientIP(req)
+	if identity == ip {
+		identity = ""
+	}
+	t.Webhooks.Notify(WebhookEvent{
+		Event:      event,
+		IP:         ip,
+		Identity:   identity,
+		Policy:     policy.Name,
+		Reason:     reason,
+		Count:      found.count,
+		Expires:    found.expires,
+		Time:       time.Now(),
+		Middleware: t.name,
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+	})
+}
+
+// storage wrappers so every round trip is timed and failures are counted
+func (t *TeapotHackerIsolationPlugin) getIpViolations(ip string) (StorageItem, error) {
+	start := time.Now()
+	found, err := t.Storage.GetIpViolations(ip)
+	t.Metrics.ObserveSince("teapot_storage_latency_seconds", "get", start)
+	if err != nil {
+		t.Metrics.Inc("teapot_storage_errors_total", "get")
+	}
+	return found, err
+}
+
+func (t *TeapotHackerIsolationPlugin) incrIpViolations(ip string, jailTime time.Duration, violation Violation) (StorageItem, error) {
+	start := time.Now()
+	found, err := t.Storage.IncrIpViolations(ip, jailTime, violation)
+	t.Metrics.ObserveSince("teapot_storage_latency_seconds", "incr", start)
+	if err != nil {
+		t.Metrics.Inc("teapot_storage_errors_total", "incr")
+	}
+	return found, err
+}
+
+func (t *TeapotHackerIsolationPlugin) DetectIfHacker(rw2 *http.Response) bool {
+	return t.DetectTrigger(rw2) != ""
+}
+
+// DetectTrigger checks the response against the default (top-level) triggers
+func (t *TeapotHackerIsolationPlugin) DetectTrigger(rw2 *http.Response) string {
+	return t.DefaultPolicy.DetectTrigger(rw2)
+}
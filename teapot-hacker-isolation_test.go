@@ -1,11 +1,16 @@
 package teapot_hacker_isolation
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 // New created a new plugin, with a config that's been set (possibly) by the admin
@@ -31,19 +36,46 @@ func CreateTestConfig() *Config {
 	return config
 }
 
+// CreateTestPlugin's backend answers by path: "teapot-header" adds the trigger header, "418" and "404" return
+// that status, "slow" takes 30ms, "export" returns 2kB, and a POST to "login" is a 401 unless the password is hunter2.
 func CreateTestPlugin(config *Config, ctx context.Context) (*TeapotHackerIsolationPlugin, error) {
 	return NewTeapotHackerIsolationPlugin(ctx, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		if strings.Contains(req.URL.Path, "teapot-header") {
 			rw.Header().Add(config.TriggerOnHeaders[0], "1")
 		}
+		if strings.Contains(req.URL.Path, "slow") {
+			time.Sleep(30 * time.Millisecond)
+		}
 		if strings.Contains(req.URL.Path, "418") {
 			rw.WriteHeader(418)
+		} else if strings.Contains(req.URL.Path, "404") {
+			rw.WriteHeader(404)
+		} else if strings.Contains(req.URL.Path, "login") && req.Method == http.MethodPost {
+			// reading the body also checks the plugin left it intact
+			body, _ := io.ReadAll(req.Body)
+			if !strings.Contains(string(body), "hunter2") {
+				rw.WriteHeader(401)
+			}
+		} else if strings.Contains(req.URL.Path, "export") {
+			rw.Write(bytes.Repeat([]byte("x"), 2048))
 		} else {
 			rw.WriteHeader(200)
 		}
 	}), config, "testing")
 }
 
+// ServeTestRequest sends one request from ip through the plugin, headers are name, value pairs
+func ServeTestRequest(plugin *TeapotHackerIsolationPlugin, method string, target string, ip string, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.RemoteAddr = net.JoinHostPort(ip, "666")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	plugin.ServeHTTP(recorder, req)
+	return recorder
+}
+
 func TestServeHTTP_IPv4(t *testing.T) {
 	NotATestServeHTTP(t, "0.1.2.3:666") // ipv
 }
@@ -186,3 +218,169 @@ func TestDetectIfHacker(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestMetricsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.MetricsPath = "/teapot-metrics"
+	if _, err := CreateTestPlugin(config, ctx); err == nil {
+		t.Error("metricsPath without metricsToken or metricsAllowedNetworks should be refused")
+	}
+	config.MetricsAllowedNetworks = []string{"10.0.0.0/8"}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.FailNow()
+	}
+
+	for i := 0; i < 3; i++ {
+		ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "")
+	}
+
+	if code := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/teapot-metrics", "0.1.2.3", "").Code; code != 403 {
+		t.Errorf("Expected metrics to be refused outside metricsAllowedNetworks, got %d", code)
+	}
+	recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/teapot-metrics", "10.1.2.3", "")
+	response := recorder.Result()
+	if response.StatusCode != 200 {
+		t.Errorf("Metrics endpoint should not be blocked, got %d", response.StatusCode)
+		return
+	}
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`teapot_requests_total{middleware="testing"} 3`,
+		`teapot_violations_total{middleware="testing",trigger="status"} 2`,
+		`teapot_bans_total{middleware="testing"} 1`,
+		`teapot_blocked_requests_total{middleware="testing"} 2`,
+		`teapot_storage_latency_seconds_count{middleware="testing",operation="incr"} 3`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics output to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestJsonLogging(t *testing.T) {
+	config := CreateTestConfig()
+	config.LogFormat = "json"
+	config.LogLevel = "debug"
+	logger, err := NewMyTraefikLoggerFromConfig(config, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	logger.stdout = buf
+	logger.Infow("request blocked", LogFields{"ip": "0.1.2.3", "action": "block", "count": 2})
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Log line isn't JSON: %s (%s)", buf.String(), err)
+	}
+	if entry["ip"] != "0.1.2.3" || entry["action"] != "block" || entry["middleware"] != "testing" || entry["level"] != "info" {
+		t.Errorf("Unexpected log entry: %s", buf.String())
+	}
+
+	config.LogLevel = "loud"
+	if _, err := NewMyTraefikLoggerFromConfig(config, "testing"); err == nil {
+		t.Error("Expected an error for an unknown log level")
+	}
+}
+
+func TestBlockedRetryHeaders(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.ReturnCurrentExpiresHeader = "X-Expires-Teapot"
+	config.ReturnRateLimitHeaders = true
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.FailNow()
+	}
+
+	recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "")
+	if recorder.Result().Header.Get("RateLimit") != `"teapot";r=1;t=120` {
+		t.Errorf("Unexpected RateLimit header %q", recorder.Result().Header.Get("RateLimit"))
+	}
+
+	response := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "").Result()
+	if response.StatusCode != 418 {
+		t.Fatalf("Expected to be blocked, got %d", response.StatusCode)
+	}
+	if response.Header.Get("Retry-After") != "120" {
+		t.Errorf("Unexpected Retry-After %q", response.Header.Get("Retry-After"))
+	}
+	if response.Header.Get("RateLimit-Policy") != `"teapot";q=2;w=120` {
+		t.Errorf("Unexpected RateLimit-Policy %q", response.Header.Get("RateLimit-Policy"))
+	}
+	if _, err := time.Parse(time.RFC3339, response.Header.Get("X-Expires-Teapot")); err != nil {
+		t.Errorf("Expires header isn't RFC 3339: %s", err)
+	}
+}
+
+func TestReasonCountersAndAdmin(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.MinInstances = 10
+	config.ReasonThresholds = map[string]int{"header": 2}
+	config.ReturnCurrentReasonsHeader = "X-Reasons-Teapot"
+	config.AdminPath = "/teapot-admin"
+	config.AdminToken = "t0ken"
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "", "Authorization", "Bearer t0ken")
+	recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/teapot-header-please", "0.1.2.3", "", "Authorization", "Bearer t0ken")
+	if recorder.Code != 200 {
+		t.Fatalf("One header violation shouldn't ban, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("X-Reasons-Teapot") != "header:X-Teapot-Detected=1, status:418=1" {
+		t.Errorf("Unexpected reasons header %q", recorder.Header().Get("X-Reasons-Teapot"))
+	}
+	if recorder = ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/teapot-header-please", "0.1.2.3", "", "Authorization", "Bearer t0ken"); recorder.Code != 418 {
+		t.Fatalf("Second header violation should ban under reasonThresholds, got %d", recorder.Code)
+	}
+
+	recorder = ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/teapot-admin?ip=0.1.2.3", "0.1.2.3", "", "Authorization", "Bearer t0ken")
+	var state struct {
+		Policies []adminPolicyState `json:"policies"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &state); err != nil {
+		t.Fatalf("Admin output isn't JSON: %s", recorder.Body.String())
+	}
+	if len(state.Policies) != 1 || !state.Policies[0].Banned || state.Policies[0].Reasons["header:X-Teapot-Detected"] != 2 {
+		t.Errorf("Unexpected admin state %s", recorder.Body.String())
+	}
+	if len(state.Policies[0].Recent) != 3 || state.Policies[0].Recent[0].Path != "/teapot-header-please" {
+		t.Errorf("Unexpected recent violations %s", recorder.Body.String())
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.AdminPath = "/teapot-admin"
+	if _, err := CreateTestPlugin(config, ctx); err == nil {
+		t.Error("adminPath without adminToken or adminAllowedNetworks should be refused")
+	}
+	config.AdminToken = "t0ken"
+	config.AdminAllowedNetworks = []string{"10.0.0.0/8", "::1"}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip       string
+		auth     string
+		expected int
+	}{
+		{"10.1.2.3", "Bearer t0ken", 400}, // allowed, but no ip parameter
+		{"::1", "bearer t0ken", 400},
+		{"10.1.2.3", "Bearer nope", 401},
+		{"10.1.2.3", "", 401},
+		{"0.1.2.3", "Bearer t0ken", 403},
+	} {
+		recorder := ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/teapot-admin", c.ip, "", "Authorization", c.auth)
+		if recorder.Code != c.expected {
+			t.Errorf("Expected %d from %s with %q, got %d", c.expected, c.ip, c.auth, recorder.Code)
+		}
+	}
+}
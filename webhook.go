@@ -0,0 +1,281 @@
+package teapot_hacker_isolation
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// WebhookConfig is one notification target (Slack, Teams, PagerDuty, ...)
+type WebhookConfig struct {
+	URL            string   `json:"url"`
+	Events         []string `json:"events"`      // ban, unban, escalation - empty means all
+	Template       string   `json:"template"`    // Go text/template over WebhookEvent, empty means the default JSON payload
+	ContentType    string   `json:"contentType"` // default: application/json
+	Secret         string   `json:"secret"`      // if set, requests are HMAC-SHA256 signed
+	Headers        []string `json:"headers"`     // "Name: value"
+	MaxRetries     int      `json:"maxRetries"`
+	RatePerMinute  int      `json:"ratePerMinute"` // 0 means unlimited
+	TimeoutSeconds int      `json:"timeoutSeconds"`
+}
+
+type WebhookEvent struct {
+	Event      string    `json:"event"`
+	IP         string    `json:"ip"`
+	Identity   string    `json:"identity,omitempty"`
+	Policy     string    `json:"policy,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Count      int       `json:"count"`
+	Expires    int64     `json:"expires,omitempty"`
+	Time       time.Time `json:"time"`
+	Middleware string    `json:"middleware"`
+	Method     string    `json:"method,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Path       string    `json:"path,omitempty"`
+}
+
+// webhookTarget has its own queue and worker, so a slow or failing receiver only delays its own notifications
+type webhookTarget struct {
+	config   WebhookConfig
+	template *template.Template
+	queue    chan WebhookEvent
+	// simple token bucket, refilled continuously at RatePerMinute
+	lock       sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+}
+
+// WebhookNotifier delivers events asynchronously through a bounded queue so ServeHTTP never waits on a receiver.
+type WebhookNotifier struct {
+	targets      []*webhookTarget
+	client       *http.Client
+	logger       *MyTraefikLogger
+	metrics      *Metrics
+	retryBackoff time.Duration
+	// cancelled by Close, which also aborts sends and retry backoffs in flight
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// defaultWebhookTemplate renders the event as the JSON object documented by WebhookEvent's tags
+const defaultWebhookTemplate = `{{json .}}`
+
+func NewWebhookNotifier(config *Config, logger *MyTraefikLogger, metrics *Metrics) (*WebhookNotifier, error) {
+	queueSize := config.WebhookQueueSize
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+	n := &WebhookNotifier{
+		client:       &http.Client{},
+		logger:       logger,
+		metrics:      metrics,
+		retryBackoff: time.Second,
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	for i, wc := range config.Webhooks {
+		if wc.URL == "" {
+			return nil, fmt.Errorf("webhook %d has no url", i)
+		}
+		target := &webhookTarget{config: wc, queue: make(chan WebhookEvent, queueSize), tokens: float64(wc.RatePerMinute), lastRefill: time.Now()}
+		source := wc.Template
+		if source == "" {
+			source = defaultWebhookTemplate
+		}
+		// the same funcs as block templates, {{json .Reason}} quotes and escapes a value for a JSON payload
+		tmpl, err := template.New(fmt.Sprintf("webhook%d", i)).Funcs(blockTemplateFuncs).Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %d template: %w", i, err)
+		}
+		target.template = tmpl
+		n.targets = append(n.targets, target)
+	}
+	metrics.RegisterCounter("teapot_webhook_deliveries_total", "Webhook notifications, by result (sent, failed, dropped, ratelimited).", "result")
+	for _, target := range n.targets {
+		n.workers.Add(1)
+		go n.run(target)
+	}
+	return n, nil
+}
+
+// Notify queues the event for every interested target, dropping it if the queue is full. Safe on a nil notifier.
+func (n *WebhookNotifier) Notify(event WebhookEvent) {
+	if n == nil {
+		return
+	}
+	for _, target := range n.targets {
+		if !target.wants(event.Event) {
+			continue
+		}
+		select {
+		case target.queue <- event:
+		default:
+			n.metrics.Inc("teapot_webhook_deliveries_total", "dropped")
+			n.logger.Warnw("webhook queue full, dropping notification", LogFields{"ip": event.IP, "action": event.Event, "url": target.config.URL})
+		}
+	}
+}
+
+// Close cancels deliveries in flight and waits for the workers to stop, anything still queued is discarded.
+func (n *WebhookNotifier) Close() {
+	if n == nil {
+		return
+	}
+	n.cancel()
+	n.workers.Wait()
+}
+
+func (n *WebhookNotifier) run(target *webhookTarget) {
+	defer n.workers.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case event := <-target.queue:
+			if !target.allow() {
+				n.metrics.Inc("teapot_webhook_deliveries_total", "ratelimited")
+				continue
+			}
+			err := n.deliver(target, event)
+			if n.ctx.Err() != nil {
+				return // closed mid-delivery, discarded like the rest of the queue
+			}
+			if err != nil {
+				n.metrics.Inc("teapot_webhook_deliveries_total", "failed")
+				n.logger.Warnw("webhook delivery failed", LogFields{"ip": event.IP, "action": event.Event, "url": target.config.URL, "error": err})
+			} else {
+				n.metrics.Inc("teapot_webhook_deliveries_total", "sent")
+			}
+		}
+	}
+}
+
+func (n *WebhookNotifier) deliver(target *webhookTarget, event WebhookEvent) error {
+	body, err := target.render(event)
+	if err != nil {
+		return err
+	}
+	backoff := n.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = n.send(target, body)
+		if err == nil || attempt >= target.config.MaxRetries || !webhookRetryable(err) {
+			return err
+		}
+		select {
+		case <-n.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *WebhookNotifier) send(target *webhookTarget, body []byte) error {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, target.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	contentType := target.config.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "teapot-hacker-isolation")
+	for _, v := range target.config.Headers {
+		if strings.Contains(v, ":") {
+			parts := strings.SplitN(v, ":", 2)
+			req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	if target.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Teapot-Timestamp", timestamp)
+		req.Header.Set("X-Teapot-Signature", "sha256="+SignWebhook(target.config.Secret, timestamp, body))
+	}
+	timeout := time.Duration(target.config.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	client := *n.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return webhookStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+type webhookStatusError int
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook returned status %d", int(e))
+}
+
+// webhookRetryable is true for transport errors, 429 and 5xx, any other status won't change by asking again
+func webhookRetryable(err error) bool {
+	var status webhookStatusError
+	if errors.As(err, &status) {
+		return status == http.StatusTooManyRequests || status >= 500
+	}
+	return true
+}
+
+// SignWebhook computes the hex HMAC-SHA256 of "timestamp.body", receivers should recompute and compare it.
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (target *webhookTarget) wants(event string) bool {
+	if len(target.config.Events) == 0 {
+		return true
+	}
+	for _, e := range target.config.Events {
+		if strings.EqualFold(e, event) {
+			return true
+		}
+	}
+	return false
+}
+
+func (target *webhookTarget) render(event WebhookEvent) ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := target.template.Execute(&buf, event)
+	return buf.Bytes(), err
+}
+
+func (target *webhookTarget) allow() bool {
+	if target.config.RatePerMinute <= 0 {
+		return true
+	}
+	target.lock.Lock()
+	defer target.lock.Unlock()
+	now := time.Now()
+	limit := float64(target.config.RatePerMinute)
+	target.tokens += now.Sub(target.lastRefill).Minutes() * limit
+	if target.tokens > limit {
+		target.tokens = limit
+	}
+	target.lastRefill = now
+	if target.tokens < 1 {
+		return false
+	}
+	target.tokens--
+	return true
+}
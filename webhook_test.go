@@ -0,0 +1,153 @@
+package teapot_hacker_isolation
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookOnBan(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	received := make(chan WebhookEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		attempts++
+		first := attempts == 1
+		lock.Unlock()
+		if first {
+			rw.WriteHeader(503) // force one retry
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		expected := "sha256=" + SignWebhook("s3cret", req.Header.Get("X-Teapot-Timestamp"), body)
+		if req.Header.Get("X-Teapot-Signature") != expected {
+			t.Errorf("Bad signature %s", req.Header.Get("X-Teapot-Signature"))
+		}
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer receiver.Close()
+
+	ctx := context.Background()
+	config := CreateTestConfig()
+	config.Webhooks = []WebhookConfig{{URL: receiver.URL, Events: []string{"ban"}, Secret: "s3cret", MaxRetries: 2}}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newPlugin.Webhooks.Close()
+	newPlugin.Webhooks.retryBackoff = time.Millisecond
+
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "")
+	ServeTestRequest(newPlugin, http.MethodGet, "http://localhost/418-please", "0.1.2.3", "")
+
+	select {
+	case event := <-received:
+		if event.Event != "ban" || event.IP != "0.1.2.3" || event.Count != 2 || event.Reason != "status:418" {
+			t.Errorf("Unexpected webhook payload %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was never delivered")
+	}
+}
+
+func TestWebhookRetriesOnlyTransientFailures(t *testing.T) {
+	for status, expected := range map[int]int{400: 1, 404: 1, 429: 3, 502: 3} {
+		var lock sync.Mutex
+		attempts := 0
+		receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			attempts++
+			lock.Unlock()
+			rw.WriteHeader(status)
+		}))
+		config := CreateTestConfig()
+		config.Webhooks = []WebhookConfig{{URL: receiver.URL, MaxRetries: 2}}
+		n, err := NewWebhookNotifier(config, NewMyTraefikLogger("test: "), NewMetrics("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.retryBackoff = time.Millisecond
+		if err := n.deliver(n.targets[0], WebhookEvent{Event: "ban"}); err == nil {
+			t.Errorf("Expected status %d to fail the delivery", status)
+		}
+		n.Close()
+		receiver.Close()
+		if attempts != expected {
+			t.Errorf("Expected %d attempts for status %d, got %d", expected, status, attempts)
+		}
+	}
+}
+
+func TestWebhookSlowTargetDoesNotDelayOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	received := make(chan WebhookEvent, 2)
+	fast := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var event WebhookEvent
+		json.NewDecoder(req.Body).Decode(&event)
+		received <- event
+	}))
+	defer fast.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	config := CreateTestConfig()
+	config.Webhooks = []WebhookConfig{{URL: slow.URL, TimeoutSeconds: 30}, {URL: fast.URL}}
+	newPlugin, err := CreateTestPlugin(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPlugin.Webhooks.Notify(WebhookEvent{Event: "ban", IP: "0.1.2.3"})
+	newPlugin.Webhooks.Notify(WebhookEvent{Event: "ban", IP: "0.1.2.4"})
+
+	select {
+	case event := <-received:
+		if event.IP != "0.1.2.3" {
+			t.Errorf("Unexpected webhook payload %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fast webhook waited on the slow one")
+	}
+
+	// the slow receiver still hasn't answered, closing must abort that request rather than wait for it
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		newPlugin.Webhooks.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Webhook workers should stop when the context is done, even mid-request")
+	}
+}
+
+func TestWebhookTemplateEscapesJson(t *testing.T) {
+	config := CreateTestConfig()
+	config.Webhooks = []WebhookConfig{{URL: "http://localhost/slack", Template: `{"text":{{json (printf "%s banned for %s" .IP .Reason)}}}`}, {URL: "http://localhost/raw"}}
+	newPlugin, err := CreateTestPlugin(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newPlugin.Webhooks.Close()
+	event := WebhookEvent{Event: "ban", IP: "0.1.2.3", Reason: `header:X-"Quoted"\n`}
+	for _, target := range newPlugin.Webhooks.targets {
+		body, err := target.render(event)
+		var decoded map[string]any
+		if err != nil || json.Unmarshal(body, &decoded) != nil {
+			t.Errorf("Expected valid JSON from %s, got %s (%v)", target.config.URL, body, err)
+		}
+	}
+}